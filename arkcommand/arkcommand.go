@@ -1,58 +1,366 @@
 package Arkcommand
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/semaphore"
 )
 
 type Arkcmd struct {
-	Name string   `json:"name"`
-	Cmd  string   `json:"cmd"`
-	Opts []string `json:"opts"`
+	Name   string   `json:"name"`
+	Cmd    string   `json:"cmd"`
+	Opts   []string `json:"opts"`
+	Params []Param  `json:"params,omitempty"`
+	ACL    *ACL     `json:"acl,omitempty"`
+	// Timeout in seconds, DefaultTimeout when zero.
+	Timeout int `json:"timeout,omitempty"`
+	// MaxOutput in bytes kept from each of stdout and stderr,
+	// DefaultMaxOutput when zero.
+	MaxOutput int `json:"max_output,omitempty"`
+	// Concurrency is how the command runs alongside config generation and
+	// other commands: ConcurrencyExclusive, ConcurrencyShared (default) or
+	// ConcurrencyNone.
+	Concurrency string `json:"concurrency,omitempty"`
+	// MaxParallel limits how many instances of the command run at once,
+	// zero means no limit.
+	MaxParallel int `json:"max_parallel,omitempty"`
+	// Privileged commands are run by the root helper when running
+	// privilege separated, all others as the service user.
+	Privileged bool `json:"privileged,omitempty"`
+
+	slots chan struct{}
+}
+
+const (
+	// ConcurrencyExclusive commands run alone, never next to config
+	// generation or any other exclusive or shared command.
+	ConcurrencyExclusive = "exclusive"
+	// ConcurrencyShared commands run next to each other but never next to
+	// config generation or an exclusive command.
+	ConcurrencyShared = "shared"
+	// ConcurrencyNone commands ignore the global lock.
+	ConcurrencyNone = "none"
+
+	// CheckPF is the entry regenerating the pf config. It only carries
+	// the ACL, no command is run for it.
+	CheckPF = "CheckPF"
+
+	// LockWeight is the size of the global lock. Exclusive holders take
+	// all of it, shared holders take one unit.
+	LockWeight = 1 << 16
+)
+
+// ACL restricts who may run a command over the socket. A peer is allowed
+// when its uid or its gid is listed. Commands without an ACL can be run by
+// anyone who can connect to the socket.
+type ACL struct {
+	Uids []int `json:"uids"`
+	Gids []int `json:"gids"`
 }
 
 type Arkcmds struct {
 	Cmds []Arkcmd `json:"cmds"`
 }
 
+const (
+	// DefaultTimeout applies to commands without a timeout in the command file.
+	DefaultTimeout = 60 * time.Second
+	// DefaultMaxOutput caps stdout and stderr, each, for commands without
+	// max_output in the command file.
+	DefaultMaxOutput = 64 * 1024
+	// killGrace is how long a canceled command gets to exit after SIGTERM
+	// before its process group is killed.
+	killGrace = 2 * time.Second
+)
+
+// Result holds what a finished command produced.
+type Result struct {
+	ExitCode  int
+	Stdout    string
+	Stderr    string
+	Duration  time.Duration
+	Truncated bool
+	TimedOut  bool
+	Canceled  bool
+}
+
 type Cmd interface {
-	Run() (int, error)
+	Bind(args map[string]string) (Cmd, error)
+	Allowed(uid, gid int) bool
+	Run(ctx context.Context) (*Result, error)
+	Stream(ctx context.Context, onLine LineFunc) (*Result, error)
+	Acquire(ctx context.Context, global *semaphore.Weighted) (func(), error)
+	Describe() (string, []Param)
+	// NeedsRoot reports whether the command is marked privileged.
+	NeedsRoot() bool
+}
+
+// LineFunc receives each line a command writes, stream is "stdout" or
+// "stderr". Calls are serialized.
+type LineFunc func(stream, line string)
+
+// limitWriter keeps the first max bytes written to it and drops the rest.
+type limitWriter struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if room := w.max - w.buf.Len(); room < len(p) {
+		w.truncated = true
+		if room > 0 {
+			w.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return w.buf.Write(p)
+}
+
+// lineWriter hands every complete line written to it to onLine before
+// passing the bytes on to w. Lines longer than max are split.
+type lineWriter struct {
+	w      io.Writer
+	stream string
+	max    int
+	mu     *sync.Mutex
+	onLine LineFunc
+	line   []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	for _, b := range p {
+		if b == '\n' {
+			lw.onLine(lw.stream, string(lw.line))
+			lw.line = lw.line[:0]
+			continue
+		}
+		lw.line = append(lw.line, b)
+		if len(lw.line) >= lw.max {
+			lw.onLine(lw.stream, string(lw.line))
+			lw.line = lw.line[:0]
+		}
+	}
+	lw.mu.Unlock()
+	return lw.w.Write(p)
 }
 
-func (ac *Arkcmd) Run() (int, error) {
-	cmd := exec.Command(ac.Cmd, ac.Opts...)
-	out, err := cmd.Output()
+// flush emits a trailing line that had no newline.
+func (lw *lineWriter) flush() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if len(lw.line) > 0 {
+		lw.onLine(lw.stream, string(lw.line))
+		lw.line = lw.line[:0]
+	}
+}
+
+func (ac *Arkcmd) timeout() time.Duration {
+	if ac.Timeout > 0 {
+		return time.Duration(ac.Timeout) * time.Second
+	}
+	return DefaultTimeout
+}
+
+func (ac *Arkcmd) maxOutput() int {
+	if ac.MaxOutput > 0 {
+		return ac.MaxOutput
+	}
+	return DefaultMaxOutput
+}
+
+// Run executes the command and returns its exit code and captured output.
+// A non-zero exit is reported both in the result and as an error, a
+// command that could not be started has an exit code of -1. The command
+// runs in its own process group which is killed when the timeout expires
+// or ctx is canceled.
+func (ac *Arkcmd) Run(ctx context.Context) (*Result, error) {
+	return ac.Stream(ctx, nil)
+}
+
+// Stream is Run but also hands every output line to onLine as soon as the
+// command writes it. The result still carries the captured output.
+func (ac *Arkcmd) Stream(ctx context.Context, onLine LineFunc) (*Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, ac.timeout())
+	defer cancel()
+	stdout := &limitWriter{max: ac.maxOutput()}
+	stderr := &limitWriter{max: ac.maxOutput()}
+	cmd := exec.CommandContext(ctx, ac.Cmd, ac.Opts...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if onLine != nil {
+		mu := &sync.Mutex{}
+		outlines := &lineWriter{w: stdout, stream: "stdout", max: ac.maxOutput(), mu: mu, onLine: onLine}
+		errlines := &lineWriter{w: stderr, stream: "stderr", max: ac.maxOutput(), mu: mu, onLine: onLine}
+		defer errlines.flush()
+		defer outlines.flush()
+		cmd.Stdout = outlines
+		cmd.Stderr = errlines
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var kill *time.Timer
+	cmd.Cancel = func() error {
+		pgid := -cmd.Process.Pid
+		kill = time.AfterFunc(killGrace, func() {
+			syscall.Kill(pgid, syscall.SIGKILL)
+		})
+		return syscall.Kill(pgid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 2 * killGrace
+	start := time.Now()
+	err := cmd.Run()
+	if kill != nil {
+		kill.Stop()
+	}
+	res := &Result{
+		ExitCode:  0,
+		Stdout:    stdout.buf.String(),
+		Stderr:    stderr.buf.String(),
+		Duration:  time.Since(start),
+		Truncated: stdout.truncated || stderr.truncated,
+	}
+	slog.Debug("Command output", "command", ac.Name, "stdout", res.Stdout, "stderr", res.Stderr)
 	if err != nil {
-		log.Println(string(out))
-		return 1, err
+		res.ExitCode = -1
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			res.ExitCode = exiterr.ExitCode()
+		}
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			res.TimedOut = true
+			err = fmt.Errorf("%s timed out after %s", ac.Name, ac.timeout())
+		case context.Canceled:
+			res.Canceled = true
+			err = fmt.Errorf("%s canceled", ac.Name)
+		}
+		return res, err
+	}
+	return res, nil
+}
+
+// Acquire waits for a free slot of the command and for its share of global,
+// the lock also held by config generation. The returned func releases both.
+func (ac *Arkcmd) Acquire(ctx context.Context, global *semaphore.Weighted) (func(), error) {
+	if ac.slots != nil {
+		select {
+		case ac.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	var weight int64
+	switch ac.Concurrency {
+	case ConcurrencyExclusive:
+		weight = LockWeight
+	case ConcurrencyNone:
+	default:
+		weight = 1
+	}
+	if weight > 0 {
+		if err := global.Acquire(ctx, weight); err != nil {
+			if ac.slots != nil {
+				<-ac.slots
+			}
+			return nil, err
+		}
+	}
+	return func() {
+		if weight > 0 {
+			global.Release(weight)
+		}
+		if ac.slots != nil {
+			<-ac.slots
+		}
+	}, nil
+}
+
+// Describe returns the name and params of the command, what clients need
+// to know to call it.
+func (ac *Arkcmd) Describe() (string, []Param) {
+	return ac.Name, ac.Params
+}
+
+func (ac *Arkcmd) NeedsRoot() bool {
+	return ac.Privileged
+}
+
+// Allowed reports whether a peer with uid and gid may run the command. Pass
+// -1 for both when the peer credentials are unknown.
+func (ac *Arkcmd) Allowed(uid, gid int) bool {
+	if ac.ACL == nil {
+		return true
+	}
+	for _, u := range ac.ACL.Uids {
+		if uid >= 0 && u == uid {
+			return true
+		}
+	}
+	for _, g := range ac.ACL.Gids {
+		if gid >= 0 && g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup returns the allowlisted command registered under name.
+func Lookup(cmds map[string]Cmd, name string) (Cmd, error) {
+	cmd, ok := cmds[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown command %q", name)
 	}
-	log.Println(string(out))
-	return 0, nil
+	return cmd, nil
 }
 
-func Init(cmdfile string) map[string]Cmd {
+func Init(cmdfile string) (map[string]Cmd, error) {
 	cmds := map[string]Cmd{}
-	log.Println("Arkcmd file loaded: ", cmdfile)
+	slog.Info("Arkcmd file loaded", "cmdfile", cmdfile)
 	jsoncmdFile, err := os.Open(cmdfile)
 	if err != nil {
-		log.Println("Error during json open file: ", err)
+		slog.Error("Error during json open file", "cmdfile", cmdfile, "err", err)
+		return nil, err
 	}
 	defer jsoncmdFile.Close()
 	byteValue, err := ioutil.ReadAll(jsoncmdFile)
 	if err != nil {
-		log.Println("Error during reading json content: ", err)
+		slog.Error("Error during reading json content", "cmdfile", cmdfile, "err", err)
+		return nil, err
 	}
 	var acmds Arkcmds
 	err = json.Unmarshal(byteValue, &acmds)
 	if err != nil {
-		log.Println("Error during unmarshal: ", err)
+		slog.Error("Error during unmarshal", "cmdfile", cmdfile, "err", err)
+		return nil, err
 	}
 	for i := 0; i < len(acmds.Cmds); i++ {
-		log.Println("json acmd:", acmds.Cmds[i].Name)
+		if acmds.Cmds[i].Name == "" || (acmds.Cmds[i].Cmd == "" && acmds.Cmds[i].Name != CheckPF) {
+			return nil, fmt.Errorf("command %d: name and cmd are required", i)
+		}
+		if err := acmds.Cmds[i].checkParams(); err != nil {
+			return nil, fmt.Errorf("command %s: %v", acmds.Cmds[i].Name, err)
+		}
+		switch acmds.Cmds[i].Concurrency {
+		case "", ConcurrencyExclusive, ConcurrencyShared, ConcurrencyNone:
+		default:
+			return nil, fmt.Errorf("command %s: unknown concurrency %q", acmds.Cmds[i].Name, acmds.Cmds[i].Concurrency)
+		}
+		if acmds.Cmds[i].MaxParallel > 0 {
+			acmds.Cmds[i].slots = make(chan struct{}, acmds.Cmds[i].MaxParallel)
+		}
+		slog.Debug("json acmd", "command", acmds.Cmds[i].Name)
 		cmds[acmds.Cmds[i].Name] = &acmds.Cmds[i]
 	}
-	return cmds
+	return cmds, nil
 }
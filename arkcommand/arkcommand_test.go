@@ -0,0 +1,33 @@
+package Arkcommand
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name string
+		cmds string
+		ok   bool
+	}{
+		{"shipped file", "", true},
+		{"checkpf without cmd", `{"name": "CheckPF", "acl": {"uids": [0]}}`, true},
+		{"other without cmd", `{"name": "RELOADPF"}`, false},
+		{"no name", `{"cmd": "/bin/echo"}`, false},
+	}
+	for _, tt := range tests {
+		file := "../cmd.json"
+		if tt.cmds != "" {
+			file = filepath.Join(t.TempDir(), "cmd.json")
+			if err := os.WriteFile(file, []byte(`{"cmds": [`+tt.cmds+`]}`), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := Init(file)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
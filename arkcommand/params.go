@@ -0,0 +1,159 @@
+package Arkcommand
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Param declares a named, typed argument of an allowlisted command. It is
+// referenced from opts as {name} and only ever substituted after validation.
+type Param struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Values []string `json:"values,omitempty"`
+	// Min and Max bound an int param. Min defaults to 0, so that an int
+	// can never be taken for an option, a negative lower bound has to be
+	// given explicitly. Max defaults to no bound.
+	Min *int `json:"min,omitempty"`
+	Max *int `json:"max,omitempty"`
+}
+
+const (
+	ParamIP    = "ip"
+	ParamCIDR  = "cidr"
+	ParamMAC   = "mac"
+	ParamTable = "table"
+	ParamInt   = "int"
+	ParamEnum  = "enum"
+)
+
+var (
+	placeholderRe = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	tableRe       = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,31}$`)
+)
+
+func (p *Param) check() error {
+	if !tableRe.MatchString(p.Name) {
+		return fmt.Errorf("invalid param name %q", p.Name)
+	}
+	switch p.Type {
+	case ParamIP, ParamCIDR, ParamMAC, ParamTable, ParamInt:
+	case ParamEnum:
+		if len(p.Values) == 0 {
+			return fmt.Errorf("param %s: enum without values", p.Name)
+		}
+	default:
+		return fmt.Errorf("param %s: unknown type %q", p.Name, p.Type)
+	}
+	return nil
+}
+
+// Validate checks v against the param type and returns its canonical form.
+func (p *Param) Validate(v string) (string, error) {
+	switch p.Type {
+	case ParamIP:
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return "", fmt.Errorf("%s: invalid ip %q", p.Name, v)
+		}
+		return ip.String(), nil
+	case ParamCIDR:
+		if ip := net.ParseIP(v); ip != nil {
+			return ip.String(), nil
+		}
+		_, ipnet, err := net.ParseCIDR(v)
+		if err != nil {
+			return "", fmt.Errorf("%s: invalid cidr %q", p.Name, v)
+		}
+		return ipnet.String(), nil
+	case ParamMAC:
+		mac, err := net.ParseMAC(v)
+		if err != nil || len(mac) != 6 {
+			return "", fmt.Errorf("%s: invalid mac %q", p.Name, v)
+		}
+		return mac.String(), nil
+	case ParamTable:
+		if !tableRe.MatchString(v) {
+			return "", fmt.Errorf("%s: invalid table name %q", p.Name, v)
+		}
+		return v, nil
+	case ParamInt:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return "", fmt.Errorf("%s: invalid integer %q", p.Name, v)
+		}
+		min := 0
+		if p.Min != nil {
+			min = *p.Min
+		}
+		if n < min || (p.Max != nil && n > *p.Max) {
+			return "", fmt.Errorf("%s: %d out of range", p.Name, n)
+		}
+		return strconv.Itoa(n), nil
+	case ParamEnum:
+		for _, allowed := range p.Values {
+			if v == allowed {
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("%s: %q is not one of %s", p.Name, v, strings.Join(p.Values, ", "))
+	}
+	return "", fmt.Errorf("%s: unknown type %q", p.Name, p.Type)
+}
+
+// checkParams makes sure every param is well formed and every placeholder
+// used in opts refers to a declared param.
+func (ac *Arkcmd) checkParams() error {
+	declared := map[string]bool{}
+	for i := range ac.Params {
+		if err := ac.Params[i].check(); err != nil {
+			return err
+		}
+		if declared[ac.Params[i].Name] {
+			return fmt.Errorf("duplicate param %s", ac.Params[i].Name)
+		}
+		declared[ac.Params[i].Name] = true
+	}
+	for _, opt := range ac.Opts {
+		for _, m := range placeholderRe.FindAllStringSubmatch(opt, -1) {
+			if !declared[m[1]] {
+				return fmt.Errorf("placeholder {%s} has no matching param", m[1])
+			}
+		}
+	}
+	return nil
+}
+
+// Bind validates args against the declared params and returns a copy of
+// the command with its placeholders substituted.
+func (ac *Arkcmd) Bind(args map[string]string) (Cmd, error) {
+	values := map[string]string{}
+	for i := range ac.Params {
+		p := &ac.Params[i]
+		v, ok := args[p.Name]
+		if !ok {
+			return nil, fmt.Errorf("missing argument %s", p.Name)
+		}
+		canon, err := p.Validate(v)
+		if err != nil {
+			return nil, err
+		}
+		values[p.Name] = canon
+	}
+	for name := range args {
+		if _, ok := values[name]; !ok {
+			return nil, fmt.Errorf("unexpected argument %s", name)
+		}
+	}
+	bound := *ac
+	bound.Opts = make([]string, len(ac.Opts))
+	for i, opt := range ac.Opts {
+		bound.Opts[i] = placeholderRe.ReplaceAllStringFunc(opt, func(m string) string {
+			return values[m[1:len(m)-1]]
+		})
+	}
+	return &bound, nil
+}
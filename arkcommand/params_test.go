@@ -0,0 +1,179 @@
+package Arkcommand
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func intp(n int) *int { return &n }
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		param Param
+		in    string
+		want  string
+		ok    bool
+	}{
+		{Param{Name: "ip", Type: ParamIP}, "172.16.1.3", "172.16.1.3", true},
+		{Param{Name: "ip", Type: ParamIP}, "2001:DB8::1", "2001:db8::1", true},
+		{Param{Name: "ip", Type: ParamIP}, "1.2.3.4;rm", "", false},
+		{Param{Name: "ip", Type: ParamIP}, "1.2.3.4 -F all", "", false},
+		{Param{Name: "ip", Type: ParamIP}, "-f", "", false},
+		{Param{Name: "ip", Type: ParamIP}, "", "", false},
+		{Param{Name: "ip", Type: ParamIP}, "172.16.1.0/24", "", false},
+
+		{Param{Name: "addr", Type: ParamCIDR}, "10.1.2.3/8", "10.0.0.0/8", true},
+		{Param{Name: "addr", Type: ParamCIDR}, "10.1.2.3", "10.1.2.3", true},
+		{Param{Name: "addr", Type: ParamCIDR}, "10.0.0.0/33", "", false},
+		{Param{Name: "addr", Type: ParamCIDR}, "10.0.0.0/8$(reboot)", "", false},
+		{Param{Name: "addr", Type: ParamCIDR}, "-T", "", false},
+
+		{Param{Name: "mac", Type: ParamMAC}, "AA:BB:CC:DD:EE:01", "aa:bb:cc:dd:ee:01", true},
+		{Param{Name: "mac", Type: ParamMAC}, "aa-bb-cc-dd-ee-01", "aa:bb:cc:dd:ee:01", true},
+		{Param{Name: "mac", Type: ParamMAC}, "00:00:5e:00:53:00:00:01", "", false},
+		{Param{Name: "mac", Type: ParamMAC}, "aa:bb:cc:dd:ee:01;id", "", false},
+
+		{Param{Name: "table", Type: ParamTable}, "bad_hosts", "bad_hosts", true},
+		{Param{Name: "table", Type: ParamTable}, "-f", "", false},
+		{Param{Name: "table", Type: ParamTable}, "allowed>", "", false},
+		{Param{Name: "table", Type: ParamTable}, "a b", "", false},
+		{Param{Name: "table", Type: ParamTable}, strings.Repeat("t", 33), "", false},
+
+		{Param{Name: "n", Type: ParamInt}, "42", "42", true},
+		{Param{Name: "n", Type: ParamInt}, "007", "7", true},
+		// Without min the lower bound is 0.
+		{Param{Name: "n", Type: ParamInt}, "0", "0", true},
+		{Param{Name: "n", Type: ParamInt}, "-1", "", false},
+		{Param{Name: "n", Type: ParamInt, Min: intp(-5)}, "-1", "-1", true},
+		{Param{Name: "n", Type: ParamInt, Min: intp(-5)}, "-6", "", false},
+		{Param{Name: "n", Type: ParamInt, Min: intp(10)}, "9", "", false},
+		{Param{Name: "n", Type: ParamInt}, "2147483647", "2147483647", true},
+		{Param{Name: "n", Type: ParamInt, Max: intp(10)}, "11", "", false},
+		{Param{Name: "n", Type: ParamInt}, "1;reboot", "", false},
+		{Param{Name: "n", Type: ParamInt}, "0x10", "", false},
+
+		{Param{Name: "t", Type: ParamEnum, Values: []string{"allowed", "subsexpr"}}, "subsexpr", "subsexpr", true},
+		{Param{Name: "t", Type: ParamEnum, Values: []string{"allowed", "subsexpr"}}, "Allowed", "", false},
+		{Param{Name: "t", Type: ParamEnum, Values: []string{"allowed", "subsexpr"}}, "allowed ", "", false},
+
+		{Param{Name: "x", Type: "string"}, "anything", "", false},
+	}
+	for _, tt := range tests {
+		got, err := tt.param.Validate(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s %q: err = %v, want ok = %v", tt.param.Type, tt.in, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s %q = %q, want %q", tt.param.Type, tt.in, got, tt.want)
+		}
+	}
+}
+
+func tableAdd() *Arkcmd {
+	return &Arkcmd{
+		Name: "TABLEADD",
+		Cmd:  "/sbin/pfctl",
+		Opts: []string{"-t", "{table}", "-T", "add", "{addr}"},
+		Params: []Param{
+			{Name: "table", Type: ParamEnum, Values: []string{"allowed", "subsexpr", "bad_hosts"}},
+			{Name: "addr", Type: ParamCIDR},
+		},
+	}
+}
+
+func TestBind(t *testing.T) {
+	tests := []struct {
+		name string
+		args map[string]string
+		want []string
+		err  string
+	}{
+		{
+			name: "substituted",
+			args: map[string]string{"table": "allowed", "addr": "172.16.1.3"},
+			want: []string{"-t", "allowed", "-T", "add", "172.16.1.3"},
+		},
+		{
+			name: "canonical",
+			args: map[string]string{"table": "bad_hosts", "addr": "10.9.9.9/8"},
+			want: []string{"-t", "bad_hosts", "-T", "add", "10.0.0.0/8"},
+		},
+		{
+			name: "missing",
+			args: map[string]string{"table": "allowed"},
+			err:  "missing argument addr",
+		},
+		{
+			name: "extra",
+			args: map[string]string{"table": "allowed", "addr": "172.16.1.3", "flush": "-F"},
+			err:  "unexpected argument flush",
+		},
+		{
+			name: "injection",
+			args: map[string]string{"table": "allowed", "addr": "1.2.3.4;rm"},
+			err:  "invalid cidr",
+		},
+		{
+			name: "option",
+			args: map[string]string{"table": "-f", "addr": "172.16.1.3"},
+			err:  "is not one of",
+		},
+		{
+			name: "placeholder",
+			args: map[string]string{"table": "allowed", "addr": "{table}"},
+			err:  "invalid cidr",
+		},
+	}
+	for _, tt := range tests {
+		ac := tableAdd()
+		cmd, err := ac.Bind(tt.args)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := cmd.(*Arkcmd).Opts; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: opts = %q, want %q", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(ac.Opts, tableAdd().Opts) {
+			t.Errorf("%s: Bind changed the command's own opts: %q", tt.name, ac.Opts)
+		}
+	}
+}
+
+func TestBindNoParams(t *testing.T) {
+	ac := &Arkcmd{Name: "RELOADPF", Cmd: "/sbin/pfctl", Opts: []string{"-f", "/etc/pf.conf"}}
+	if _, err := ac.Bind(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ac.Bind(map[string]string{"file": "/tmp/evil.conf"}); err == nil {
+		t.Fatal("extra argument accepted by a command without params")
+	}
+}
+
+func TestCheckParams(t *testing.T) {
+	tests := []struct {
+		name string
+		ac   Arkcmd
+		ok   bool
+	}{
+		{"declared", *tableAdd(), true},
+		{"undeclared placeholder", Arkcmd{Opts: []string{"{ip}"}}, false},
+		{"duplicate", Arkcmd{Params: []Param{{Name: "ip", Type: ParamIP}, {Name: "ip", Type: ParamIP}}}, false},
+		{"unknown type", Arkcmd{Params: []Param{{Name: "x", Type: "string"}}}, false},
+		{"enum without values", Arkcmd{Params: []Param{{Name: "t", Type: ParamEnum}}}, false},
+		{"bad name", Arkcmd{Params: []Param{{Name: "a-b", Type: ParamIP}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.ac.checkParams(); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// commands returns the commands of the entries in the file path.
+func commands(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var cmds []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		cmds = append(cmds, e.Command)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return cmds
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	line, _ := json.Marshal(Entry{Time: now, Command: "c0"})
+	// Two entries fit in a file, the third one rotates it.
+	l, err := Open(path, int64(2*(len(line)+1)), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := l.Write(Entry{Time: now, Command: fmt.Sprintf("c%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		path:        {"c8", "c9"},
+		path + ".1": {"c6", "c7"},
+		path + ".2": {"c4", "c5"},
+		path + ".3": {"c2", "c3"},
+	}
+	for name, cmds := range want {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0600 {
+			t.Errorf("%s: mode %v, want 0600", name, perm)
+		}
+		if got := commands(t, name); fmt.Sprint(got) != fmt.Sprint(cmds) {
+			t.Errorf("%s holds %v, want %v", name, got, cmds)
+		}
+	}
+	if _, err := os.Stat(path + ".4"); !os.IsNotExist(err) {
+		t.Errorf("%s.4 kept beyond keep = 3: %v", path, err)
+	}
+}
+
+func TestRotateKeepNone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, cmd := range []string{"a", "b", "c"} {
+		if err := l.Write(Entry{Command: cmd}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := commands(t, path); fmt.Sprint(got) != "[c]" {
+		t.Errorf("%s holds %v, want [c]", path, got)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("%s.1 kept with keep = 0: %v", path, err)
+	}
+}
+
+func TestReopenAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for _, cmd := range []string{"a", "b"} {
+		l, err := Open(path, 0, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Write(Entry{Command: cmd}); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	}
+	if got := commands(t, path); fmt.Sprint(got) != "[a b]" {
+		t.Errorf("%s holds %v, want [a b]", path, got)
+	}
+}
+
+func TestWriteClosed(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if err := l.Write(Entry{Command: "a"}); err == nil {
+		t.Fatal("write to a closed log succeeded")
+	}
+}
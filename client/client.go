@@ -0,0 +1,162 @@
+// Package client talks to arkgated over its unix socket.
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rbaylon/arkgated/ipc"
+)
+
+const (
+	DefaultSocket = "/tmp/arkgated.sock"
+	// DefaultMaxReply bounds the size of a single reply frame.
+	DefaultMaxReply = 16 * 1024 * 1024
+)
+
+// Client is a connection to the daemon. Requests on one Client are sent one
+// at a time, use several Clients to run commands in parallel.
+//
+// When Do fails before the final response was read, for instance because
+// ctx expired, that response may still arrive. The connection is closed
+// then and every later Do fails, dial a new Client instead.
+type Client struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	r        *bufio.Reader
+	seq      uint64
+	err      error
+	MaxReply int
+}
+
+// Dial connects to the daemon socket at path, giving up after timeout.
+func Dial(path string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, r: bufio.NewReader(conn), MaxReply: DefaultMaxReply}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends req and waits for its final response. Output lines of a
+// streamed request are handed to onOutput, which may be nil. A response
+// that is not OK is returned together with its *ipc.Error.
+func (c *Client) Do(ctx context.Context, req *ipc.Request, onOutput func(ipc.Output)) (*ipc.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, fmt.Errorf("connection closed after an earlier request failed: %w", c.err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if req.Version == 0 {
+		req.Version = ipc.Version
+	}
+	if req.ID == "" {
+		c.seq++
+		req.ID = strconv.FormatUint(c.seq, 10)
+	}
+	deadline, _ := ctx.Deadline()
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	if err := ipc.WriteMsg(c.conn, req); err != nil {
+		return nil, c.fail(ctx, err)
+	}
+	for {
+		var resp ipc.Response
+		if err := ipc.ReadMsg(c.r, c.MaxReply, &resp); err != nil {
+			return nil, c.fail(ctx, err)
+		}
+		if resp.ID != req.ID {
+			return nil, c.fail(ctx, fmt.Errorf("reply for request %q while waiting for %q", resp.ID, req.ID))
+		}
+		if resp.Output != nil {
+			if onOutput != nil {
+				onOutput(*resp.Output)
+			}
+			continue
+		}
+		if !resp.OK && resp.Error != nil {
+			return &resp, resp.Error
+		}
+		return &resp, nil
+	}
+}
+
+// fail closes the connection, whose replies can no longer be matched to
+// requests, and reports a context error in place of the i/o error it
+// caused. Called with c.mu held.
+func (c *Client) fail(ctx context.Context, err error) error {
+	switch {
+	case ctx.Err() != nil:
+		err = ctx.Err()
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		// The connection deadline is ctx's, it can pass before ctx
+		// notices.
+		err = context.DeadlineExceeded
+	}
+	c.err = err
+	c.conn.Close()
+	return err
+}
+
+// Run executes the allowlisted command name with args.
+func (c *Client) Run(ctx context.Context, name string, args map[string]string) (*ipc.Response, error) {
+	return c.Do(ctx, &ipc.Request{Name: name, Args: args}, nil)
+}
+
+// Regenerate rebuilds the pf config through CheckPF, which reloads it when
+// it changed. The response's Diff shows what changed.
+func (c *Client) Regenerate(ctx context.Context) (*ipc.Response, error) {
+	return c.Run(ctx, "CheckPF", nil)
+}
+
+// Status returns the daemon status.
+func (c *Client) Status(ctx context.Context) (*ipc.Status, error) {
+	resp, err := c.Run(ctx, ipc.StatusCmd, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Status, nil
+}
+
+// Commands lists the commands the caller is allowed to run.
+func (c *Client) Commands(ctx context.Context) ([]ipc.CommandInfo, error) {
+	resp, err := c.Run(ctx, ipc.ListCmd, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Commands, nil
+}
+
+// Job runs one of the job.* requests for job id.
+func (c *Client) Job(ctx context.Context, op string, id string) (*ipc.JobStatus, error) {
+	args := map[string]string{"id": id}
+	if deadline, ok := ctx.Deadline(); ok && op == ipc.JobWaitCmd {
+		if secs := int(time.Until(deadline).Seconds()); secs > 0 {
+			args["timeout"] = strconv.Itoa(secs)
+		}
+	}
+	resp, err := c.Run(ctx, op, args)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Job, nil
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rbaylon/arkgated/ipc"
+)
+
+// pipe returns a Client and the daemon's end of its connection.
+func pipe(t *testing.T) (*Client, net.Conn) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return &Client{conn: a, r: bufio.NewReader(a), MaxReply: DefaultMaxReply}, b
+}
+
+// serve answers every request on conn after delay.
+func serve(conn net.Conn, delay time.Duration) {
+	r := bufio.NewReader(conn)
+	for {
+		var req ipc.Request
+		if err := ipc.ReadMsg(r, DefaultMaxReply, &req); err != nil {
+			return
+		}
+		time.Sleep(delay)
+		if err := ipc.WriteMsg(conn, &ipc.Response{Version: ipc.Version, ID: req.ID, OK: true}); err != nil {
+			return
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	c, conn := pipe(t)
+	go serve(conn, 0)
+	for i := 0; i < 3; i++ {
+		resp, err := c.Run(context.Background(), "TESTPF", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.OK {
+			t.Fatalf("resp = %+v", resp)
+		}
+	}
+}
+
+func TestDoTimeoutCloses(t *testing.T) {
+	c, conn := pipe(t)
+	go serve(conn, 200*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.Run(ctx, "TESTPF", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want DeadlineExceeded", err)
+	}
+	// The late reply must not be taken for the next request's.
+	if resp, err := c.Run(context.Background(), "TESTPF", nil); err == nil {
+		t.Fatalf("resp = %+v after a timed out request, want an error", resp)
+	}
+}
+
+func TestDoCanceledBeforeSend(t *testing.T) {
+	c, conn := pipe(t)
+	go serve(conn, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Run(ctx, "TESTPF", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want Canceled", err)
+	}
+	if _, err := c.Run(context.Background(), "TESTPF", nil); err != nil {
+		t.Fatalf("connection unusable after a request that was never sent: %v", err)
+	}
+}
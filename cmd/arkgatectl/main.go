@@ -0,0 +1,182 @@
+// Command arkgatectl runs commands on arkgated through its unix socket.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/namsral/flag"
+	"github.com/rbaylon/arkgated/client"
+	"github.com/rbaylon/arkgated/ipc"
+)
+
+const usage = `usage: arkgatectl [flags] <command> [args]
+
+commands:
+  run NAME [key=value ...]   run an allowlisted command
+  regen                      regenerate the pf config, reload it if it changed
+  status                     show daemon status
+  list-commands              list the commands you may run
+  job status|wait|cancel ID  inspect or cancel an async job
+
+flags:
+`
+
+func main() {
+	flags := flag.NewFlagSet("arkgatectl", flag.ExitOnError)
+	var (
+		sockfile = flags.String("socketfile", client.DefaultSocket, "Path to the arkgated socket")
+		timeout  = flags.Duration("timeout", 5*time.Minute, "Give up waiting for a reply after this long")
+		async    = flags.Bool("async", false, "Start the command as a job and print its id")
+		stream   = flags.Bool("stream", false, "Print command output as it is produced")
+		asjson   = flags.Bool("json", false, "Print raw JSON replies")
+	)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+	args := flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	c, err := client.Dial(*sockfile, 5*time.Second)
+	if err != nil {
+		fatal(err)
+	}
+	defer c.Close()
+
+	var req *ipc.Request
+	switch args[0] {
+	case "run":
+		if len(args) < 2 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		cmdargs, err := parseArgs(args[2:])
+		if err != nil {
+			fatal(err)
+		}
+		req = &ipc.Request{Name: args[1], Args: cmdargs, Async: *async, Stream: *stream}
+	case "regen":
+		req = &ipc.Request{Name: "CheckPF", Async: *async, Stream: *stream}
+	case "status":
+		req = &ipc.Request{Name: ipc.StatusCmd}
+	case "list-commands":
+		req = &ipc.Request{Name: ipc.ListCmd}
+	case "job":
+		if len(args) != 3 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		req = &ipc.Request{Name: "job." + args[1], Args: map[string]string{"id": args[2]}}
+		if req.Name == ipc.JobWaitCmd {
+			req.Args["timeout"] = fmt.Sprintf("%d", int(timeout.Seconds()))
+		}
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var onOutput func(ipc.Output)
+	if *stream && !*asjson {
+		onOutput = func(o ipc.Output) {
+			if o.Stream == "stderr" {
+				fmt.Fprintln(os.Stderr, o.Line)
+			} else {
+				fmt.Println(o.Line)
+			}
+		}
+	}
+	resp, err := c.Do(ctx, req, onOutput)
+	if resp == nil {
+		fatal(err)
+	}
+	if *asjson {
+		out, _ := json.MarshalIndent(resp, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		show(req.Name, resp, *stream)
+	}
+	if err != nil {
+		if !*asjson {
+			fmt.Fprintln(os.Stderr, "arkgatectl:", err)
+		}
+		if resp.ExitCode > 0 {
+			os.Exit(resp.ExitCode)
+		}
+		os.Exit(1)
+	}
+}
+
+func parseArgs(kvs []string) (map[string]string, error) {
+	if len(kvs) == 0 {
+		return nil, nil
+	}
+	args := map[string]string{}
+	for _, kv := range kvs {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("argument %q is not key=value", kv)
+		}
+		args[k] = v
+	}
+	return args, nil
+}
+
+// show prints a reply for humans. Output already printed while streaming is
+// not repeated.
+func show(name string, resp *ipc.Response, streamed bool) {
+	switch {
+	case resp.Status != nil:
+		st := resp.Status
+		fmt.Printf("version:   %s\nrouter:    %s\nuptime:    %s\n", st.Version, st.Router, time.Duration(st.Uptime)*time.Second)
+		fmt.Printf("enrolled:  %v %s\n", st.Enrolled, st.EnrollError)
+		fmt.Printf("token:     valid=%v", st.TokenValid)
+		if st.TokenExpires != nil {
+			fmt.Printf(" expires=%s", st.TokenExpires.Format(time.RFC3339))
+		}
+		fmt.Println()
+		if st.LastSync != nil {
+			fmt.Printf("last sync: %s\n", st.LastSync.Format(time.RFC3339))
+		}
+		if st.LastSyncFailure != nil {
+			fmt.Printf("last fail: %s %s\n", st.LastSyncFailure.Format(time.RFC3339), st.SyncError)
+		}
+		fmt.Printf("pf.conf:   %s\nvouchers:  %d\nsubs:      %d\n", st.PfConfHash, st.Vouchers, st.Subs)
+		fmt.Printf("queued:    %d\nrunning:   %d\n", st.Queued, st.Running)
+	case name == ipc.ListCmd:
+		for _, cmd := range resp.Commands {
+			var params []string
+			for _, p := range cmd.Params {
+				params = append(params, fmt.Sprintf("%s=<%s>", p.Name, p.Type))
+			}
+			fmt.Println(strings.TrimSpace(cmd.Name + " " + strings.Join(params, " ")))
+		}
+	case resp.Job != nil:
+		job := resp.Job
+		fmt.Printf("job %s (%s): %s\n", job.ID, job.Name, job.State)
+		if job.Result != nil {
+			show(job.Name, job.Result, false)
+		}
+	default:
+		fmt.Print(resp.Diff)
+		if !streamed {
+			fmt.Print(resp.Stdout)
+			fmt.Fprint(os.Stderr, resp.Stderr)
+		}
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "arkgatectl:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,200 @@
+package pfconfig
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// diffContext is the number of unchanged lines around each change.
+	diffContext = 3
+	// maxDiffEdits bounds the work spent finding a shortest diff, beyond
+	// it the file is shown as replaced as a whole.
+	maxDiffEdits = 1000
+	// maxDiff bounds the diff of one file, in bytes.
+	maxDiff = 256 * 1024
+)
+
+// edit is one line of a diff, op is ' ', '-' or '+'.
+type edit struct {
+	op   byte
+	line string
+}
+
+// unifiedDiff returns the unified diff from a to b, the old and new
+// content of the file name.
+func unifiedDiff(name string, a, b []byte) string {
+	edits := diffLines(splitLines(string(a)), splitLines(string(b)))
+	// before[i] holds the old and new line numbers preceding edits[i].
+	before := make([][2]int, len(edits)+1)
+	for i, e := range edits {
+		before[i+1] = before[i]
+		if e.op != '+' {
+			before[i+1][0]++
+		}
+		if e.op != '-' {
+			before[i+1][1]++
+		}
+	}
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- a/%s\n+++ b/%s\n", name, name)
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+		// Extend the hunk over changes no more than two contexts apart.
+		end := i
+		for {
+			for end < len(edits) && edits[end].op != ' ' {
+				end++
+			}
+			next := end
+			for next < len(edits) && edits[next].op == ' ' && next-end < 2*diffContext {
+				next++
+			}
+			if next == len(edits) || edits[next].op == ' ' {
+				break
+			}
+			end = next
+		}
+		start, stop := max(i-diffContext, 0), min(end+diffContext, len(edits))
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(before[start][0], before[stop][0]-before[start][0]),
+			hunkRange(before[start][1], before[stop][1]-before[start][1]))
+		for _, e := range edits[start:stop] {
+			if out.Len() > maxDiff {
+				out.WriteString("... diff truncated\n")
+				return out.String()
+			}
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = stop
+	}
+	return out.String()
+}
+
+// hunkRange formats the lines following line start, count of them.
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// splitLines splits s after every newline.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the edits turning a into b.
+func diffLines(a, b []string) []edit {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	var edits []edit
+	for _, l := range a[:pre] {
+		edits = append(edits, edit{' ', l})
+	}
+	edits = append(edits, shortestEdits(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+	for _, l := range a[len(a)-suf:] {
+		edits = append(edits, edit{' ', l})
+	}
+	return edits
+}
+
+// shortestEdits finds a shortest edit script with Myers' algorithm.
+// trace[d][k+d] is the furthest x reached on diagonal k = x-y with d
+// edits.
+func shortestEdits(a, b []string) []edit {
+	n, m := len(a), len(b)
+	var trace [][]int
+	for d := 0; ; d++ {
+		if d > maxDiffEdits {
+			return replaceAll(a, b)
+		}
+		v := make([]int, 2*d+1)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			switch {
+			case d == 0:
+			case k == -d || (k != d && trace[d-1][k-1+d-1] < trace[d-1][k+1+d-1]):
+				x = trace[d-1][k+1+d-1]
+			default:
+				x = trace[d-1][k-1+d-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+d] = x
+			if x >= n && y >= m {
+				return backtrack(append(trace, v), a, b)
+			}
+		}
+		trace = append(trace, v)
+	}
+}
+
+func backtrack(trace [][]int, a, b []string) []edit {
+	x, y := len(a), len(b)
+	var rev []edit
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		k := x - y
+		pk := k - 1
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			pk = k + 1
+		}
+		px := prev[pk+d-1]
+		py := px - pk
+		for x > px && y > py {
+			rev = append(rev, edit{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == px {
+			rev = append(rev, edit{'+', b[y-1]})
+		} else {
+			rev = append(rev, edit{'-', a[x-1]})
+		}
+		x, y = px, py
+	}
+	for x > 0 {
+		rev = append(rev, edit{' ', a[x-1]})
+		x--
+	}
+	edits := make([]edit, len(rev))
+	for i, e := range rev {
+		edits[len(rev)-1-i] = e
+	}
+	return edits
+}
+
+func replaceAll(a, b []string) []edit {
+	edits := make([]edit, 0, len(a)+len(b))
+	for _, l := range a {
+		edits = append(edits, edit{'-', l})
+	}
+	for _, l := range b {
+		edits = append(edits, edit{'+', l})
+	}
+	return edits
+}
@@ -0,0 +1,137 @@
+package pfconfig
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{
+			name: "new file",
+			a:    "",
+			b:    "172.16.1.10\n172.16.1.11\n",
+			want: "@@ -0,0 +1,2 @@\n+172.16.1.10\n+172.16.1.11\n",
+		},
+		{
+			name: "emptied",
+			a:    "172.16.1.10\n",
+			b:    "",
+			want: "@@ -1 +0,0 @@\n-172.16.1.10\n",
+		},
+		{
+			name: "changed line",
+			a:    "a\nb\nc\nd\ne\nf\ng\nh\n",
+			b:    "a\nb\nc\nd\nE\nf\ng\nh\n",
+			want: "@@ -2,7 +2,7 @@\n b\n c\n d\n-e\n+E\n f\n g\n h\n",
+		},
+		{
+			name: "appended",
+			a:    "a\nb\nc\nd\n",
+			b:    "a\nb\nc\nd\ne\n",
+			want: "@@ -2,3 +2,4 @@\n b\n c\n d\n+e\n",
+		},
+		{
+			name: "two hunks",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			b:    "x\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ny\n",
+			want: "@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n" +
+				"@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+y\n",
+		},
+		{
+			name: "joined hunks",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n",
+			b:    "x\n2\n3\n4\n5\n6\n7\ny\n",
+			want: "@@ -1,8 +1,8 @@\n-1\n+x\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+y\n",
+		},
+		{
+			name: "no newline at end",
+			a:    "a\nb",
+			b:    "a\nb\n",
+			want: "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+	}
+	for _, tt := range tests {
+		got := unifiedDiff("f.txt", []byte(tt.a), []byte(tt.b))
+		want := "--- a/f.txt\n+++ b/f.txt\n" + tt.want
+		if got != want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tt.name, got, want)
+		}
+	}
+}
+
+// TestUnifiedDiffApplies checks that every diff turns a into b, removing
+// the deleted and adding the inserted lines in order.
+func TestUnifiedDiffApplies(t *testing.T) {
+	a := "pass in on $lan from 172.16.1.10\npass in on $lan from 172.16.1.11\n"
+	for i := 0; i < 40; i++ {
+		a += fmt.Sprintf("line %d\n", i)
+	}
+	b := strings.Replace(a, "line 7\n", "", 1)
+	b = strings.Replace(b, "line 30\n", "line 30\nline 30b\n", 1)
+	b = "set skip on lo0\n" + b
+	diff := unifiedDiff("pf.conf", []byte(a), []byte(b))
+	if got := apply(t, a, diff); got != b {
+		t.Fatalf("applying\n%s\ngives\n%s\nwant\n%s", diff, got, b)
+	}
+}
+
+// apply applies a diff made by unifiedDiff of files ending in a newline.
+func apply(t *testing.T, a, diff string) string {
+	t.Helper()
+	old := splitLines(a)
+	var out []string
+	next := 0
+	for _, line := range splitLines(diff)[2:] {
+		if strings.HasPrefix(line, "@@") {
+			// An empty range starts after its line, others at it.
+			start, n := 0, 1
+			fmt.Sscanf(line, "@@ -%d,%d", &start, &n)
+			if n > 0 {
+				start--
+			}
+			out = append(out, old[next:start]...)
+			next = start
+			continue
+		}
+		switch line[0] {
+		case ' ', '-':
+			if old[next] != line[1:] {
+				t.Fatalf("diff expects %q at line %d, file has %q", line[1:], next+1, old[next])
+			}
+			if line[0] == ' ' {
+				out = append(out, line[1:])
+			}
+			next++
+		case '+':
+			out = append(out, line[1:])
+		}
+	}
+	return strings.Join(append(out, old[next:]...), "")
+}
+
+func TestUnifiedDiffLimits(t *testing.T) {
+	var a, b strings.Builder
+	for i := 0; i < 2*maxDiffEdits; i++ {
+		fmt.Fprintf(&a, "a%d\n", i)
+		fmt.Fprintf(&b, "b%d\n", i)
+	}
+	diff := unifiedDiff("big", []byte(a.String()), []byte(b.String()))
+	if !strings.HasPrefix(diff, "--- a/big\n+++ b/big\n@@ -1,2000 +1,2000 @@\n-a0\n") {
+		t.Errorf("replaced file diff starts with\n%.80s", diff)
+	}
+
+	a.Reset()
+	for a.Len() < 2*maxDiff {
+		a.WriteString(strings.Repeat("x", 99) + "\n")
+	}
+	diff = unifiedDiff("huge", nil, []byte(a.String()))
+	if len(diff) > maxDiff+200 || !strings.HasSuffix(diff, "... diff truncated\n") {
+		t.Errorf("diff of %d bytes is %d bytes long, ending %q", a.Len(), len(diff), diff[len(diff)-20:])
+	}
+}
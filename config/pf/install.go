@@ -0,0 +1,309 @@
+package pfconfig
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	Arkcommand "github.com/rbaylon/arkgated/arkcommand"
+)
+
+const (
+	// Pfctl checks and loads rulesets.
+	Pfctl = "/sbin/pfctl"
+	// pfctlTimeout bounds every pfctl run of an install.
+	pfctlTimeout = 5 * time.Minute
+)
+
+// File is one generated file, Name is relative to rundir.
+type File struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
+
+// Installer installs a generation of files, pf.conf among them, and loads
+// it. Nothing is left changed when it fails.
+type Installer interface {
+	Install(ctx context.Context, files []File) (*InstallResult, error)
+}
+
+// InstallResult tells what an install changed.
+type InstallResult struct {
+	// Changes lists the files that differed from the installed ones.
+	Changes []Change `json:"changes,omitempty"`
+	// Reloaded is set when the ruleset was loaded.
+	Reloaded bool `json:"reloaded,omitempty"`
+	// Tables lists the tables updated in place instead.
+	Tables []string `json:"tables,omitempty"`
+}
+
+// Change is a file that differed from the installed one.
+type Change struct {
+	Name string `json:"name"`
+	// Hash is the hex sha256 of the new content, OldHash that of the
+	// installed file, empty when there was none.
+	Hash    string `json:"sha256"`
+	OldHash string `json:"old_sha256,omitempty"`
+	// Diff is the unified diff from the installed file.
+	Diff string `json:"diff"`
+}
+
+// PfctlError is pfctl refusing a ruleset.
+type PfctlError struct {
+	// Args are the pfctl arguments, such as -nf pf.conf.
+	Args   []string
+	Output string
+	Err    error
+}
+
+func (e *PfctlError) Error() string {
+	msg := strings.TrimSpace(e.Output)
+	if msg == "" {
+		msg = e.Err.Error()
+	}
+	return "pfctl " + strings.Join(e.Args, " ") + ": " + msg
+}
+
+func (e *PfctlError) Unwrap() error {
+	return e.Err
+}
+
+// DirInstaller installs files into Dir and loads PfConf, which is
+// expected to be or include Dir's pf.conf.
+//
+// Files whose sha256 matches the installed one are left alone. The others
+// are first staged as name.new. When pf.conf or a table file it names
+// changed, pf.conf is checked with pfctl -nf against the staged tables.
+// Then the files are renamed into place one by one, their previous
+// versions kept as name.old, and the ruleset is updated if the check ran.
+//
+// When only table files changed, each table loaded from one of them is
+// replaced with the new file's addresses by pfctl -T replace, which swaps
+// the table atomically and keeps the queues and states of the running
+// ruleset. Otherwise, or when that fails, PfConf is loaded. When the load
+// fails the previous files are put back. pf loads a ruleset in one
+// transaction, so the running one is left as it was, apart from the tables
+// already replaced before the load was tried.
+type DirInstaller struct {
+	Dir    string
+	PfConf string
+	// Pfctl is the pfctl to run, the package's Pfctl when empty.
+	Pfctl string
+}
+
+func (d *DirInstaller) Install(ctx context.Context, files []File) (*InstallResult, error) {
+	res := &InstallResult{}
+	var conf []byte
+	var changed []File
+	for _, f := range files {
+		if f.Name == "pf.conf" {
+			conf = f.Data
+		}
+		old, err := os.ReadFile(d.Dir + f.Name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		c := Change{Name: f.Name, Hash: Hash(f.Data)}
+		if err == nil {
+			c.OldHash = Hash(old)
+		}
+		if c.Hash == c.OldHash {
+			continue
+		}
+		c.Diff = unifiedDiff(f.Name, old, f.Data)
+		res.Changes = append(res.Changes, c)
+		changed = append(changed, f)
+	}
+	if conf == nil {
+		return nil, errors.New("no pf.conf to install")
+	}
+	if len(changed) == 0 {
+		return res, nil
+	}
+
+	staged := make([]string, 0, len(changed))
+	defer func() {
+		for _, path := range staged {
+			os.Remove(path)
+		}
+	}()
+	load := false
+	for _, f := range changed {
+		path := d.Dir + f.Name
+		if err := os.WriteFile(path+".new", f.Data, 0600); err != nil {
+			return nil, err
+		}
+		staged = append(staged, path+".new")
+		load = load || f.Name == "pf.conf" || bytes.Contains(conf, []byte(`"`+path+`"`))
+	}
+	if load {
+		if err := d.check(ctx, conf, changed); err != nil {
+			return nil, err
+		}
+	}
+
+	var installed []File
+	for _, f := range changed {
+		if err := d.replace(f.Name); err != nil {
+			d.restore(installed)
+			return nil, err
+		}
+		installed = append(installed, f)
+	}
+	staged = nil
+	if !load {
+		return res, nil
+	}
+	if updates, ok := d.tableUpdates(conf, changed); ok {
+		err := d.updateTables(ctx, updates)
+		if err == nil {
+			for _, u := range updates {
+				res.Tables = append(res.Tables, u.table)
+			}
+			return res, nil
+		}
+		slog.Warn("Updating tables failed, loading the whole ruleset", "err", err)
+	}
+	if err := d.pfctl(ctx, "-f", d.PfConf); err != nil {
+		d.restore(installed)
+		slog.Warn("Loading pf config failed, restored the previous files", "pfconf", d.PfConf, "err", err)
+		return nil, err
+	}
+	res.Reloaded = true
+	return res, nil
+}
+
+// check runs pfctl -nf on a copy of conf whose table files are the staged
+// ones among files.
+func (d *DirInstaller) check(ctx context.Context, conf []byte, files []File) error {
+	for _, f := range files {
+		if f.Name == "pf.conf" {
+			continue
+		}
+		path := d.Dir + f.Name
+		conf = bytes.ReplaceAll(conf, []byte(`"`+path+`"`), []byte(`"`+path+`.new"`))
+	}
+	path := d.Dir + "pf.conf.check"
+	if err := os.WriteFile(path, conf, 0600); err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	return d.pfctl(ctx, "-nf", path)
+}
+
+// replace moves name.new over name, keeping a link to the old file as
+// name.old.
+func (d *DirInstaller) replace(name string) error {
+	path := d.Dir + name
+	os.Remove(path + ".old")
+	if err := os.Link(path, path+".old"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Rename(path+".new", path)
+}
+
+// restore puts back the previous versions of files, removing those that
+// did not exist before.
+func (d *DirInstaller) restore(files []File) {
+	for _, f := range files {
+		path := d.Dir + f.Name
+		err := os.Rename(path+".old", path)
+		if errors.Is(err, os.ErrNotExist) {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			slog.Error("Unable to restore previous file", "file", path, "err", err)
+		}
+	}
+}
+
+// tableUpdate is a table to replace with the content of the file path.
+type tableUpdate struct {
+	table string
+	path  string
+}
+
+// tableUpdates returns the tables loaded from the changed files. ok is
+// false when pf.conf changed or a changed file named in it is not the
+// only source of one table.
+func (d *DirInstaller) tableUpdates(conf []byte, changed []File) (updates []tableUpdate, ok bool) {
+	for _, f := range changed {
+		if f.Name == "pf.conf" {
+			return nil, false
+		}
+		path := d.Dir + f.Name
+		if !bytes.Contains(conf, []byte(`"`+path+`"`)) {
+			continue
+		}
+		table, ok := tableFor(conf, path)
+		if !ok {
+			return nil, false
+		}
+		updates = append(updates, tableUpdate{table: table, path: path})
+	}
+	return updates, true
+}
+
+// tableFor returns the table loaded from the file path by conf. ok is
+// false unless exactly one table is and the file is all it holds.
+func tableFor(conf []byte, path string) (table string, ok bool) {
+	for _, m := range tableDecl.FindAllSubmatch(conf, -1) {
+		files := tableFile.FindAllSubmatch(m[2], -1)
+		found := false
+		for _, f := range files {
+			found = found || string(f[1]) == path
+		}
+		if !found {
+			continue
+		}
+		if table != "" || len(files) > 1 || bytes.Contains(m[2], []byte("{")) {
+			return "", false
+		}
+		table = string(m[1])
+	}
+	return table, table != ""
+}
+
+var (
+	// tableDecl matches a table declaration, capturing its name and
+	// options.
+	tableDecl = regexp.MustCompile(`(?m)^\s*table\s+<([^>]+)>(.*)$`)
+	// tableFile matches a file option, capturing the path.
+	tableFile = regexp.MustCompile(`\bfile\s+"([^"]*)"`)
+)
+
+// updateTables replaces the tables of updates with pfctl -T replace.
+func (d *DirInstaller) updateTables(ctx context.Context, updates []tableUpdate) error {
+	for _, u := range updates {
+		if err := d.pfctl(ctx, "-t", u.table, "-T", "replace", "-f", u.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hash returns the hex sha256 of data.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *DirInstaller) pfctl(ctx context.Context, args ...string) error {
+	path := d.Pfctl
+	if path == "" {
+		path = Pfctl
+	}
+	cmd := &Arkcommand.Arkcmd{Name: "pfctl", Cmd: path, Opts: args, Timeout: int(pfctlTimeout.Seconds())}
+	res, err := cmd.Run(ctx)
+	if err != nil {
+		return &PfctlError{Args: args, Output: res.Stderr, Err: err}
+	}
+	return nil
+}
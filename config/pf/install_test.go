@@ -0,0 +1,263 @@
+package pfconfig
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stub is a DirInstaller over a temporary directory whose pfctl only logs
+// its arguments and fails when they start with the content of a file
+// named fail.
+type stub struct {
+	*DirInstaller
+	t   *testing.T
+	dir string
+}
+
+func newStub(t *testing.T) *stub {
+	dir := t.TempDir() + "/"
+	script := "#!/bin/sh\n" +
+		"echo \"$*\" >> " + dir + "pfctl.log\n" +
+		"if [ -f " + dir + "fail ] && [ \"$1\" = \"$(cat " + dir + "fail)\" ]; then\n" +
+		"\techo \"pfctl: syntax error\" >&2\n\texit 1\nfi\n"
+	if err := os.WriteFile(dir+"pfctl", []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return &stub{DirInstaller: &DirInstaller{Dir: dir, PfConf: dir + "pf.conf", Pfctl: dir + "pfctl"}, t: t, dir: dir}
+}
+
+// conf returns a pf.conf loading the allowed table from wifilist.txt.
+func (s *stub) conf(rules string) File {
+	return File{Name: "pf.conf", Data: []byte(`table <allowed> persist file "` + s.dir + `wifilist.txt"` + "\n" + rules)}
+}
+
+// calls returns and forgets the pfctl runs so far.
+func (s *stub) calls() []string {
+	data, err := os.ReadFile(s.dir + "pfctl.log")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	os.Remove(s.dir + "pfctl.log")
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// state returns the content and modification time of every file in the
+// directory but pfctl's own.
+func (s *stub) state() map[string]string {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	st := map[string]string{}
+	for _, e := range entries {
+		if e.Name() == "pfctl" || e.Name() == "pfctl.log" {
+			continue
+		}
+		data, err := os.ReadFile(s.dir + e.Name())
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		fi, err := e.Info()
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		st[e.Name()] = fi.ModTime().Format(time.RFC3339Nano) + " " + string(data)
+	}
+	return st
+}
+
+func (s *stub) install(files ...File) *InstallResult {
+	s.t.Helper()
+	res, err := s.Install(context.Background(), files)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return res
+}
+
+func names(changes []Change) []string {
+	var n []string
+	for _, c := range changes {
+		n = append(n, c.Name)
+	}
+	return n
+}
+
+func wantCalls(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pfctl runs:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestInstallFirst(t *testing.T) {
+	s := newStub(t)
+	res := s.install(s.conf("pass all\n"), File{Name: "wifilist.txt", Data: []byte("172.16.1.10\n")})
+	if !res.Reloaded || len(res.Tables) != 0 {
+		t.Errorf("res = %+v, want a reload", res)
+	}
+	if got := names(res.Changes); !reflect.DeepEqual(got, []string{"pf.conf", "wifilist.txt"}) {
+		t.Errorf("changed %v", got)
+	}
+	if c := res.Changes[1]; c.OldHash != "" || c.Hash != Hash([]byte("172.16.1.10\n")) {
+		t.Errorf("change = %+v", c)
+	}
+	wantCalls(t, s.calls(), "-nf "+s.dir+"pf.conf.check", "-f "+s.dir+"pf.conf")
+	st := s.state()
+	if len(st) != 2 || !strings.HasSuffix(st["wifilist.txt"], " 172.16.1.10\n") {
+		t.Errorf("directory holds %q", st)
+	}
+}
+
+func TestInstallUnchanged(t *testing.T) {
+	s := newStub(t)
+	files := []File{s.conf("pass all\n"), {Name: "wifilist.txt", Data: []byte("172.16.1.10\n")}}
+	s.install(files...)
+	s.calls()
+	before := s.state()
+	res := s.install(files...)
+	if len(res.Changes) != 0 || res.Reloaded || len(res.Tables) != 0 {
+		t.Errorf("res = %+v for an unchanged generation", res)
+	}
+	wantCalls(t, s.calls())
+	if after := s.state(); !reflect.DeepEqual(after, before) {
+		t.Errorf("directory went from\n%q\nto\n%q", before, after)
+	}
+}
+
+func TestInstallTableOnly(t *testing.T) {
+	s := newStub(t)
+	conf := s.conf("pass all\n")
+	s.install(conf, File{Name: "wifilist.txt", Data: []byte("172.16.1.10\n172.16.1.11\n")})
+	s.calls()
+	res := s.install(conf, File{Name: "wifilist.txt", Data: []byte("172.16.1.11\n172.16.1.12\n")})
+	if res.Reloaded || !reflect.DeepEqual(res.Tables, []string{"allowed"}) {
+		t.Errorf("res = %+v, want the allowed table updated", res)
+	}
+	if got := names(res.Changes); !reflect.DeepEqual(got, []string{"wifilist.txt"}) {
+		t.Errorf("changed %v", got)
+	}
+	if d := res.Changes[0].Diff; !strings.Contains(d, "-172.16.1.10\n") || !strings.Contains(d, "+172.16.1.12\n") {
+		t.Errorf("diff:\n%s", d)
+	}
+	wantCalls(t, s.calls(),
+		"-nf "+s.dir+"pf.conf.check",
+		"-t allowed -T replace -f "+s.dir+"wifilist.txt")
+}
+
+func TestInstallConfChanged(t *testing.T) {
+	s := newStub(t)
+	list := File{Name: "wifilist.txt", Data: []byte("172.16.1.10\n")}
+	s.install(s.conf("pass all\n"), list)
+	s.calls()
+	res := s.install(s.conf("block all\n"), list)
+	if !res.Reloaded || len(res.Tables) != 0 {
+		t.Errorf("res = %+v, want a reload", res)
+	}
+	if got := names(res.Changes); !reflect.DeepEqual(got, []string{"pf.conf"}) {
+		t.Errorf("changed %v", got)
+	}
+	wantCalls(t, s.calls(), "-nf "+s.dir+"pf.conf.check", "-f "+s.dir+"pf.conf")
+	if data, _ := os.ReadFile(s.dir + "pf.conf.old"); !strings.Contains(string(data), "pass all") {
+		t.Errorf("pf.conf.old holds %q", data)
+	}
+}
+
+func TestInstallCheckFails(t *testing.T) {
+	s := newStub(t)
+	list := File{Name: "wifilist.txt", Data: []byte("172.16.1.10\n")}
+	s.install(s.conf("pass all\n"), list)
+	s.calls()
+	before := s.state()
+	os.WriteFile(s.dir+"fail", []byte("-nf"), 0600)
+	defer os.Remove(s.dir + "fail")
+	_, err := s.Install(context.Background(), []File{s.conf("pass al\n"), {Name: "wifilist.txt", Data: []byte("172.16.1.11\n")}})
+	var pe *PfctlError
+	if !errors.As(err, &pe) || !strings.Contains(err.Error(), "syntax error") {
+		t.Fatalf("err = %v, want pfctl's error", err)
+	}
+	wantCalls(t, s.calls(), "-nf "+s.dir+"pf.conf.check")
+	after := s.state()
+	delete(after, "fail")
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("directory went from\n%q\nto\n%q", before, after)
+	}
+}
+
+func TestInstallLoadFails(t *testing.T) {
+	s := newStub(t)
+	list := File{Name: "wifilist.txt", Data: []byte("172.16.1.10\n")}
+	s.install(s.conf("pass all\n"), list)
+	s.calls()
+	os.WriteFile(s.dir+"fail", []byte("-f"), 0600)
+	defer os.Remove(s.dir + "fail")
+	if _, err := s.Install(context.Background(), []File{s.conf("block all\n"), list}); err == nil {
+		t.Fatal("install succeeded although pfctl -f failed")
+	}
+	for name, want := range map[string]string{"pf.conf": "pass all", "wifilist.txt": "172.16.1.10"} {
+		if data, _ := os.ReadFile(filepath.Join(s.dir, name)); !strings.Contains(string(data), want) {
+			t.Errorf("%s holds %q after a failed load, want the previous content", name, data)
+		}
+	}
+}
+
+func TestInstallTableUpdateFails(t *testing.T) {
+	s := newStub(t)
+	conf := s.conf("pass all\n")
+	s.install(conf, File{Name: "wifilist.txt", Data: []byte("172.16.1.10\n")})
+	s.calls()
+	os.WriteFile(s.dir+"fail", []byte("-t"), 0600)
+	defer os.Remove(s.dir + "fail")
+	res := s.install(conf, File{Name: "wifilist.txt", Data: []byte("172.16.1.11\n")})
+	if !res.Reloaded || len(res.Tables) != 0 {
+		t.Errorf("res = %+v, want a reload after the table update failed", res)
+	}
+	calls := s.calls()
+	if len(calls) == 0 || calls[len(calls)-1] != "-f "+s.dir+"pf.conf" {
+		t.Errorf("pfctl runs:\n%s\nwant a load last", strings.Join(calls, "\n"))
+	}
+}
+
+// TestCreateSubChurn goes through Create with the default template: an
+// inactive subscriber only changes the subsexpr table file, activating one
+// adds its queues and rules to pf.conf.
+func TestCreateSubChurn(t *testing.T) {
+	s := newStub(t)
+	c := &PfConfig{Router: "devopenbsd", Ifaces: fixture().Ifaces, WifiIpList: "wifilist.txt", SubsIpList: "subslist.txt"}
+	sub := func(mac, ip, status string) Sub {
+		return Sub{Mac: mac, FramedIp: ip, Type: "subs", Downspeed: 30, Upspeed: 10, Gateway: "10.0.1.1", Status: status}
+	}
+	create := func(subs ...Sub) *Summary {
+		t.Helper()
+		sum, err := c.Create(context.Background(), s.dir, &PfConfig{Subs: subs}, s.DirInstaller)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+	active := sub("AA:BB:CC:DD:EE:01", "172.16.2.1", "active")
+	create(active)
+	s.calls()
+
+	sum := create(active, sub("AA:BB:CC:DD:EE:02", "172.16.2.2", "expired"))
+	if sum.Reloaded || !reflect.DeepEqual(sum.Tables, []string{"subsexpr"}) {
+		t.Errorf("inactive sub: %+v, want only the subsexpr table replaced", sum)
+	}
+	wantCalls(t, s.calls(),
+		"-nf "+s.dir+"pf.conf.check",
+		"-t subsexpr -T replace -f "+s.dir+"subslist.txt")
+
+	sum = create(active, sub("AA:BB:CC:DD:EE:02", "172.16.2.2", "active"))
+	if !sum.Reloaded {
+		t.Errorf("activated sub: %+v, want a reload", sum)
+	}
+}
@@ -1,12 +1,12 @@
 package pfconfig
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"math/rand/v2"
-	"net/http"
+	"log/slog"
 	"os"
 	"strings"
 	"time"
@@ -84,26 +84,10 @@ type PfConfig struct {
 	Subs              []Sub     `json:"subs"`
 }
 
-func GetSubs(url string, token *string) (*PfConfig, error) {
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", *token))
-	res, err := client.Do(req)
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
-	defer res.Body.Close()
-	responseData, ioerr := ioutil.ReadAll(res.Body)
-	if ioerr != nil {
-		return nil, ioerr
-	}
-	var cfg PfConfig
-	json.Unmarshal(responseData, &cfg)
-	return &cfg, nil
-}
-
-func (c *PfConfig) DhcpCreate(rundir string) error {
+// DhcpConf renders dhcpd.conf with a fixed address for every sub. Host
+// names are made unique with the mac address so that the file only
+// changes along with the subs.
+func (c *PfConfig) DhcpConf() []byte {
 	dhcp := ""
 	hosts := ""
 	for _, d := range c.Dhcps {
@@ -114,7 +98,7 @@ func (c *PfConfig) DhcpCreate(rundir string) error {
     	hardware ethernet %s;
     	fixed-address %s;
   	}
-`, h.FirstName+fmt.Sprintf("%d", rand.IntN(100000))+h.LastName, strings.ToLower(h.Mac), h.FramedIp)
+`, h.FirstName+strings.ToLower(ident(h.Mac))+h.LastName, strings.ToLower(h.Mac), h.FramedIp)
 				hosts = fmt.Sprintf("%s%s", hosts, host_block)
 			}
 		}
@@ -129,255 +113,120 @@ subnet %s netmask %s {
 		dhcp = fmt.Sprintf("%s%s", dhcp, net_block)
 		hosts = ""
 	}
-	err := os.WriteFile(rundir+"dhcpd.conf", []byte(dhcp), 0600)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-	return nil
+	return []byte(dhcp)
 }
 
-func (c *PfConfig) Create(rundir string, urlbase string, t *string) error {
-	var macros string
-	for _, v := range c.Ifaces {
-		macros = fmt.Sprintf("%s%s = \"%s\"\n", macros, v.Name, v.Device)
-	}
-	tables := heredoc.Docf(`
-table <allowed> persist file "%s"
-table <subsexpr> persist file "%s"
-table <bad_hosts> persist
-table <martians> { 0.0.0.0/8 169.254.0.0/16  \ 
-       192.0.0.0/24 192.0.2.0/24 224.0.0.0/3 \
-       198.18.0.0/15 198.51.100.0/24 \ 
-       203.0.113.0/24 } 
-set block-policy drop 
-set loginterface egress 
-set skip on lo0
-set state-defaults pflow
-set limit states 500000
-set limit frags 10000
-`, rundir+c.WifiIpList, rundir+c.SubsIpList)
-	var queues string
-	var defiface string
-	for _, v := range c.Ifaces {
-		queues = fmt.Sprintf("%squeue %s on { $%s } bandwidth %s\nqueue %sdef parent %s bandwidth 2M default\n",
-			queues, v.Name, v.Name, v.Speed, v.Name, v.Name)
-		if v.Default {
-			defiface = v.Name
-		}
-	}
-	queues = queues + heredoc.Docf(`
-queue selfq parent %s bandwidth 10M min 5M max 10M burst 15M for 100ms 
-queue apps parent %s bandwidth 10M 
-queue  ssh_interactive parent apps bandwidth 5M min 2M 
-queue  ssh_bulk parent apps bandwidth 5M max 5M
-# insert new queueus after this line 
-`, defiface, defiface)
-	matches := "match in all scrub (no-df random-id max-mss 1440)\n"
-	var nats string
-	for _, v := range c.Ifaces {
-		if v.Type == "external" {
-			nats = fmt.Sprintf("%smatch out on { $%s } inet from !($%s:network) to any nat-to ($%s:0)\n",
-				nats, v.Name, v.Name, v.Name)
-		} else {
-			if v.Name != "management" {
-				nats = fmt.Sprintf("%smatch in on { $%s } proto tcp from <subsexpr> to any port { 80, 443 } rdr-to 127.0.0.1 port %d\n",
-					nats, v.Name, c.SubsPortalPort)
-				nats = fmt.Sprintf("%smatch in on { $%s } proto tcp from !<allowed> to any port { 80, 443 } rdr-to 127.0.0.1 port %d\n",
-					nats, v.Name, c.CaptivePortalPort)
-			}
-		}
-		nats = fmt.Sprintf("%smatch out on { $%s } proto udp set prio 4\n",
-			nats, v.Name)
-	}
-	matches = matches + nats
-	defaultblock := heredoc.Doc(`
-# default bock
-block all
-block in quick from <bad_hosts>
-block in quick from <martians>
-`)
-	var defaultqrules string
-	for _, v := range c.Ifaces {
-		defaultqrules = fmt.Sprintf("%sblock return out on { $%s } inet all set queue %sdef\n",
-			defaultqrules, v.Name, v.Name)
-	}
-	var passrules string
-	var gws []string
-	var extifs []string
-	for _, v := range c.Ifaces {
-		if v.Type == "external" {
-			extifs = append(extifs, v.Name)
-			gws = append(gws, v.Gateway)
-		}
-	}
-	var gateways string
-	var lbrules string
-	if c.LoadBalance {
-		gateways = fmt.Sprintf("route-to { %s } round-robin sticky-address", strings.Join(gws, " "))
-		for _, g := range extifs {
-			for _, v := range c.Ifaces {
-				if v.Type == "external" {
-					if v.Name != g {
-						lbrules = fmt.Sprintf("%spass out on $%s from $%s route-to %s\n", lbrules, g, v.Name, v.Gateway)
-					}
-				}
-			}
-		}
-	} else {
-		gateways = ""
-		lbrules = ""
-	}
+// Summary describes the config installed by Create.
+type Summary struct {
+	// Vouchers and Subs count the active ones.
+	Vouchers int
+	Subs     int
+	// PfConfHash is the hex sha256 of pf.conf.
+	PfConfHash string
+	// Hashes maps every generated file to the hex sha256 of its content.
+	Hashes map[string]string
+	// Changes lists the files that differed from the installed ones,
+	// Reloaded tells whether pf loaded the new ruleset and Tables which
+	// tables were updated in place instead.
+	Changes  []Change
+	Reloaded bool
+	Tables   []string
+}
 
-	for _, v := range c.Ifaces {
-		if v.Type == "external" {
-			passrules = fmt.Sprintf("%spass out quick on { $%s } proto {udp, tcp} to any port 53\n", passrules, v.Name)
-			if v.Default {
-				passrules = fmt.Sprintf("%spass in on { $%s } inet proto tcp from any to $%s:0 port 22 keep state (max-src-conn-rate 10/10, overload <bad_hosts> flush global) set queue (ssh_interactive, ssh_bulk)\n",
-					passrules, v.Name, v.Name)
-				passrules = fmt.Sprintf("%spass out on { $%s } from { $%s:0 } to any set queue selfq\n", passrules, v.Name, v.Name)
-			}
-			passrules = fmt.Sprintf("%spass out on { $%s } inet proto icmp from { $%s:0 } to any\n", passrules, v.Name, v.Name)
-			passrules = fmt.Sprintf("%spass out on { $%s } from { $%s:0 } to any\n", passrules, v.Name, v.Name)
-		} else {
-			passrules = fmt.Sprintf("%spass in quick on { $%s } proto {udp, tcp} to any port 53\n", passrules, v.Name)
-			passrules = fmt.Sprintf("%spass out on { $%s } from { $%s:0 }\n", passrules, v.Name, v.Name)
-			passrules = fmt.Sprintf("%spass in on { $%s } inet proto tcp from any to { $%s:0, 127.0.0.1 } port { %d, %d, 22, 667 }\n", passrules, v.Name, v.Name, c.CaptivePortalPort, c.SubsPortalPort)
-			passrules = fmt.Sprintf("%spass in quick on { $%s } inet proto tcp from any to $%s:0 port = 22 keep state\n", passrules, v.Name, v.Name)
-			passrules = fmt.Sprintf("%spass in quick on { $%s } inet proto tcp from any to $%s:0 port = 9100 keep state\n", passrules, v.Name, v.Name)
-			passrules = fmt.Sprintf("%spass in quick on { $%s } inet proto tcp from any to $%s:0 port = 9000 keep state\n", passrules, v.Name, v.Name)
-			passrules = fmt.Sprintf("%spass in quick on { $%s } inet proto udp from any port = bootpc to 255.255.255.255 port = bootps keep state\n", passrules, v.Name)
-			passrules = fmt.Sprintf("%spass in quick on { $%s } inet proto udp from any port = bootpc to { $%s:0 } port = bootps keep state\n", passrules, v.Name, v.Name)
-			passrules = fmt.Sprintf("%spass out quick on { $%s } inet proto udp from { $%s:0 } port = bootps to any port = bootpc keep state\n", passrules, v.Name, v.Name)
-		}
-	}
+// Diff returns the unified diff of every changed file, empty when nothing
+// changed.
+func (s *Summary) Diff() string {
+	var b strings.Builder
+	for _, c := range s.Changes {
+		b.WriteString(c.Diff)
+	}
+	return b.String()
+}
 
-	newpfcfg, err := GetSubs(urlbase+"pfconfig/query/"+c.Router, t)
+// Create generates pf.conf, the table files and dhcpd.conf for the
+// vouchers and subscribers in newpfcfg, as fetched from the api, and
+// installs and loads them as one generation through inst. pf.conf is
+// rendered from the template described at LoadTemplate.
+func (c *PfConfig) Create(ctx context.Context, rundir string, newpfcfg *PfConfig, inst Installer) (*Summary, error) {
+	tmpl, err := LoadTemplate(rundir)
 	if err != nil {
-		log.Println(err)
-		return err
-	}
-	var subqueue string
-	var subpass string
-	for _, i := range c.Ifaces {
-		for _, voucher := range newpfcfg.Vouchers {
-			if voucher.Status == "active" {
-				if i.Type == "external" {
-					subqueue = fmt.Sprintf("%squeue %s%s parent %s bandwidth %dM min 5M max %dM\n",
-						subqueue, voucher.Value, i.Name, i.Name, voucher.Upspeed, voucher.Upspeed)
-					subpass = fmt.Sprintf("%spass out on $%s set queue %s%s tagged \"%s\"\n",
-						subpass, i.Name, voucher.Value, i.Name, voucher.Value)
-				} else {
-					gateways = ""
-					if voucher.Gateway != "" {
-						gateways = fmt.Sprintf("route-to %s", voucher.Gateway)
-					}
-					subqueue = fmt.Sprintf("%squeue %s%s parent %s bandwidth %dM min 5M max %dM burst %dM for %dms\n",
-						subqueue, voucher.Value, i.Name, i.Name, voucher.Downspeed, voucher.Downspeed, voucher.Burstspeed, voucher.Duration)
-					subpass = fmt.Sprintf("%spass in on $%s from %s %s set queue %s%s tag \"%s\"\n",
-						subpass, i.Name, voucher.Ip, gateways, voucher.Value, i.Name, voucher.Value)
-				}
-			}
-		}
-		for _, sub := range newpfcfg.Subs {
-			if sub.Status == "active" {
-				ident := strings.Replace(sub.Mac, ":", "", -1)
-				priority := ""
-				if sub.Priority > 0 {
-					priority = fmt.Sprintf("set prio %d", sub.Priority)
-				}
-				if i.Type == "external" {
-					subqueue = fmt.Sprintf("%squeue %s%s parent %s bandwidth %dM min 5M max %dM\n", subqueue, ident, i.Name, i.Name, sub.Upspeed, sub.Upspeed)
-					subpass = fmt.Sprintf("%spass out on $%s set queue %s%s %s tagged \"%s\"\n",
-						subpass, i.Name, ident, i.Name, priority, ident)
-					/*ulbw := sub.Upspeed - 1
-					subqueue = fmt.Sprintf("%squeue %s%s parent %s bandwidth %dM min 5M max %dM\n",
-						subqueue, ident, i.Name, i.Name, sub.Upspeed, sub.Upspeed)
-					subqueue = fmt.Sprintf("%squeue %s%sack parent %s%s bandwidth 5M min 1M\n", subqueue, ident, i.Name, ident, i.Name)
-					subqueue = fmt.Sprintf("%squeue %s%sdata parent %s%s bandwidth %dM min 5M max %dM\n", subqueue, ident, i.Name, ident, i.Name, ulbw, sub.Upspeed)
-					subpass = fmt.Sprintf("%spass out on $%s set queue ( %s%sdata, %s%sack ) %s tagged \"%s\"\n",
-						subpass, i.Name, ident, i.Name, ident, i.Name, priority, ident)
-					*/
-				} else {
-					if i.Name == sub.Type {
-						//dlbw := sub.Downspeed - 1
-						gateways = ""
-						if sub.Gateway != "" {
-							gateways = fmt.Sprintf("route-to %s", sub.Gateway)
-						}
-						subqueue = fmt.Sprintf("%squeue %s%s parent %s bandwidth %dM min 5M max %dM burst %dM for %dms\n",
-							subqueue, ident, i.Name, i.Name, sub.Downspeed, sub.Downspeed, sub.Burstspeed, sub.Duration)
-						subpass = fmt.Sprintf("%spass in on $%s from %s %s set queue %s%s %s tag \"%s\"\n",
-							subpass, i.Name, sub.FramedIp, gateways, ident, i.Name, priority, ident)
-						/*
-							subqueue = fmt.Sprintf("%squeue %s%s parent %s bandwidth %dM min 5M max %dM\n",
-								subqueue, ident, i.Name, i.Name, sub.Downspeed, sub.Downspeed)
-							subqueue = fmt.Sprintf("%squeue %s%sack parent %s%s bandwidth 5M min 1M\n", subqueue, ident, i.Name, ident, i.Name)
-							subqueue = fmt.Sprintf("%squeue %s%sdata parent %s%s bandwidth %dM min 5M max %dM burst %dM for %dms\n", subqueue, ident, i.Name, ident, i.Name, dlbw, sub.Downspeed, sub.Burstspeed, sub.Duration)
-							subpass = fmt.Sprintf("%spass in on $%s from %s %s set queue ( %s%sdata, %s%sack ) %s tag \"%s\"\n",
-								subpass, i.Name, sub.FramedIp, gateways, ident, i.Name, ident, i.Name, priority, ident)
-						*/
-					}
-				}
-			}
-		}
+		slog.Error("Unable to load pf.conf template", "router", c.Router, "err", err)
+		return nil, err
 	}
+	data := c.templateData(rundir, newpfcfg)
+	sum := &Summary{Vouchers: len(data.Vouchers), Subs: len(data.Subs)}
 	var wifilist string
 	var subslist string
 	for _, voucher := range newpfcfg.Vouchers {
 		if voucher.Status == "active" {
 			wifilist = fmt.Sprintf("%s%s\n", wifilist, voucher.Ip)
+			slog.Debug("Voucher allowed", "router", c.Router, "voucher", voucher.Value, "ip", voucher.Ip, "list", c.WifiIpList)
+		} else {
+			slog.Debug("Voucher skipped", "router", c.Router, "voucher", voucher.Value, "status", voucher.Status)
 		}
 	}
 	for _, sub := range newpfcfg.Subs {
 		if sub.Status == "active" {
 			wifilist = fmt.Sprintf("%s%s\n", wifilist, sub.FramedIp)
+			slog.Debug("Sub allowed", "router", c.Router, "mac", sub.Mac, "ip", sub.FramedIp, "list", c.WifiIpList)
 		} else {
 			subslist = fmt.Sprintf("%s%s\n", subslist, sub.FramedIp)
+			slog.Debug("Sub redirected to the subs portal", "router", c.Router, "mac", sub.Mac, "ip", sub.FramedIp,
+				"list", c.SubsIpList, "status", sub.Status)
 		}
 	}
-	os.Rename(rundir+c.WifiIpList, rundir+c.WifiIpList+".old")
-	err = os.WriteFile(rundir+c.WifiIpList, []byte(wifilist), 0600)
-	if err != nil {
-		log.Println(err)
-		return err
+	var conf bytes.Buffer
+	if err := tmpl.Execute(&conf, data); err != nil {
+		slog.Error("Unable to render pf.conf", "router", c.Router, "err", err)
+		return nil, err
 	}
-	os.Rename(rundir+c.SubsIpList, rundir+c.SubsIpList+".old")
-	err = os.WriteFile(rundir+c.SubsIpList, []byte(subslist), 0600)
-	if err != nil {
-		log.Println(err)
-		return err
+	files := []File{
+		{Name: c.WifiIpList, Data: []byte(wifilist)},
+		{Name: c.SubsIpList, Data: []byte(subslist)},
+		{Name: "pf.conf", Data: conf.Bytes()},
+		{Name: "dhcpd.conf", Data: newpfcfg.DhcpConf()},
 	}
-	configstring := macros + tables + queues + subqueue + matches + defaultblock + defaultqrules + passrules + subpass + lbrules
-	err = os.WriteFile(rundir+"pf.conf", []byte(configstring), 0600)
+	res, err := inst.Install(ctx, files)
 	if err != nil {
-		log.Println(err)
-		return err
+		slog.Error("Unable to install pf config", "router", c.Router, "err", err)
+		return nil, err
 	}
-	err = newpfcfg.DhcpCreate(rundir)
-	if err != nil {
-		log.Println(err)
-		return err
+	sum.Hashes = map[string]string{}
+	for _, f := range files {
+		sum.Hashes[f.Name] = Hash(f.Data)
+	}
+	sum.PfConfHash = sum.Hashes["pf.conf"]
+	sum.Changes, sum.Reloaded, sum.Tables = res.Changes, res.Reloaded, res.Tables
+	if len(sum.Changes) == 0 {
+		slog.Info("pf config unchanged", "router", c.Router, "vouchers", sum.Vouchers, "subs", sum.Subs)
+		return sum, nil
+	}
+	var names []string
+	for _, ch := range sum.Changes {
+		names = append(names, ch.Name)
 	}
-	return nil
+	slog.Info("pf config created", "router", c.Router, "vouchers", sum.Vouchers, "subs", sum.Subs,
+		"changed", strings.Join(names, ","), "reloaded", sum.Reloaded, "tables", strings.Join(sum.Tables, ","))
+	slog.Debug("pf config changes", "router", c.Router, "diff", sum.Diff())
+	return sum, nil
 }
 
 func Init(config string) (*PfConfig, error) {
 	jsoncmdFile, err := os.Open(config)
 	if err != nil {
-		log.Println("Error during json open file: ", err)
+		slog.Error("Error during json open file", "config", config, "err", err)
 		return nil, err
 	}
 	defer jsoncmdFile.Close()
 	byteValue, err := ioutil.ReadAll(jsoncmdFile)
 	if err != nil {
-		log.Println("Error during reading json content: ", err)
+		slog.Error("Error during reading json content", "config", config, "err", err)
 		return nil, err
 	}
 	var cfg PfConfig
 	err = json.Unmarshal(byteValue, &cfg)
 	if err != nil {
-		log.Println("Error during unmarshal: ", err)
+		slog.Error("Error during unmarshal", "config", config, "err", err)
 		return nil, err
 	}
 	return &cfg, nil
@@ -0,0 +1,187 @@
+package pfconfig
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/rbaylon/arkgated/config/pf/ruleset"
+)
+
+// Rules is the default policy built from config.json and the api, split
+// into the named blocks of the pf.conf template.
+type Rules struct {
+	Macros  []ruleset.Macro
+	Tables  []ruleset.Table
+	Options []ruleset.Option
+	// Queues are the interface and system queues, SubQueues those of the
+	// vouchers and subs.
+	Queues    []ruleset.Queue
+	SubQueues []ruleset.Queue
+	Match     []ruleset.Rule
+	Block     []ruleset.Rule
+	// Pass holds the interface rules, SubPass those of the vouchers and
+	// subs and LoadBalance the rules spreading traffic over the external
+	// interfaces.
+	Pass        []ruleset.Rule
+	SubPass     []ruleset.Rule
+	LoadBalance []ruleset.Rule
+}
+
+// ident turns a mac address into the queue and tag name of a sub.
+func ident(mac string) string {
+	return strings.Replace(mac, ":", "", -1)
+}
+
+// buildRules builds the default policy for d.
+func buildRules(d *TemplateData) *Rules {
+	r := &Rules{}
+	for _, i := range d.Ifaces {
+		r.Macros = append(r.Macros, ruleset.Macro{Name: i.Name, Value: i.Device})
+	}
+	r.Tables = []ruleset.Table{
+		{Name: "allowed", Persist: true, File: d.AllowedFile},
+		{Name: "subsexpr", Persist: true, File: d.SubsexprFile},
+		{Name: "bad_hosts", Persist: true},
+		{Name: "martians", Addrs: []string{"0.0.0.0/8", "169.254.0.0/16",
+			"192.0.0.0/24", "192.0.2.0/24", "224.0.0.0/3",
+			"198.18.0.0/15", "198.51.100.0/24",
+			"203.0.113.0/24"}},
+	}
+	r.Options = []ruleset.Option{
+		{Name: "block-policy", Value: "drop"},
+		{Name: "loginterface", Value: "egress"},
+		{Name: "skip", Value: "on lo0"},
+		{Name: "state-defaults", Value: "pflow"},
+		{Name: "limit", Value: "states 500000"},
+		{Name: "limit", Value: "frags 10000"},
+	}
+
+	for _, i := range d.Ifaces {
+		r.Queues = append(r.Queues,
+			ruleset.Queue{Name: i.Name, On: "$" + i.Name, Bandwidth: i.Speed},
+			ruleset.Queue{Name: i.Name + "def", Parent: i.Name, Bandwidth: "2M", Default: true})
+	}
+	r.Queues = append(r.Queues,
+		ruleset.Queue{Name: "selfq", Parent: d.DefaultIface, Bandwidth: "10M", Min: "5M", Max: "10M", Burst: "15M", BurstFor: 100},
+		ruleset.Queue{Name: "apps", Parent: d.DefaultIface, Bandwidth: "10M"},
+		ruleset.Queue{Name: "ssh_interactive", Parent: "apps", Bandwidth: "5M", Min: "2M"},
+		ruleset.Queue{Name: "ssh_bulk", Parent: "apps", Bandwidth: "5M", Max: "5M"})
+
+	r.Match = append(r.Match, ruleset.Rule{Action: "match", Dir: "in", All: true, Scrub: "(no-df random-id max-mss 1440)"})
+	for _, i := range d.Ifaces {
+		on := "$" + i.Name
+		if i.Type == "external" {
+			r.Match = append(r.Match, ruleset.Rule{Action: "match", Dir: "out", On: on, AF: "inet",
+				From: []string{"!(" + on + ":network)"}, To: []string{"any"}, NatTo: "(" + on + ":0)"})
+		} else if i.Name != "management" {
+			web := []string{"80", "443"}
+			r.Match = append(r.Match,
+				ruleset.Rule{Action: "match", Dir: "in", On: on, Proto: []string{"tcp"},
+					From: []string{"<subsexpr>"}, To: []string{"any"}, ToPort: web,
+					RdrTo: "127.0.0.1 port " + strconv.Itoa(d.SubsPortalPort)},
+				ruleset.Rule{Action: "match", Dir: "in", On: on, Proto: []string{"tcp"},
+					From: []string{"!<allowed>"}, To: []string{"any"}, ToPort: web,
+					RdrTo: "127.0.0.1 port " + strconv.Itoa(d.CaptivePortalPort)})
+		}
+		r.Match = append(r.Match, ruleset.Rule{Action: "match", Dir: "out", On: on, Proto: []string{"udp"}, Prio: 4})
+	}
+
+	r.Block = []ruleset.Rule{
+		{Action: "block", All: true},
+		{Action: "block", Dir: "in", Quick: true, From: []string{"<bad_hosts>"}},
+		{Action: "block", Dir: "in", Quick: true, From: []string{"<martians>"}},
+	}
+	for _, i := range d.Ifaces {
+		r.Block = append(r.Block, ruleset.Rule{Action: "block", Return: true, Dir: "out", On: "$" + i.Name,
+			AF: "inet", All: true, Queue: []string{i.Name + "def"}})
+	}
+
+	udptcp := []string{"udp", "tcp"}
+	for _, i := range d.Ifaces {
+		on := "$" + i.Name
+		self := on + ":0"
+		if i.Type == "external" {
+			r.Pass = append(r.Pass, ruleset.Rule{Action: "pass", Dir: "out", Quick: true, On: on, Proto: udptcp, ToPort: []string{"53"}})
+			if i.Default {
+				r.Pass = append(r.Pass,
+					ruleset.Rule{Action: "pass", Dir: "in", On: on, AF: "inet", Proto: []string{"tcp"},
+						From: []string{"any"}, To: []string{self}, ToPort: []string{"22"},
+						KeepState: true, StateOpts: "max-src-conn-rate 10/10, overload <bad_hosts> flush global",
+						Queue: []string{"ssh_interactive", "ssh_bulk"}},
+					ruleset.Rule{Action: "pass", Dir: "out", On: on, From: []string{self}, To: []string{"any"}, Queue: []string{"selfq"}})
+			}
+			r.Pass = append(r.Pass,
+				ruleset.Rule{Action: "pass", Dir: "out", On: on, AF: "inet", Proto: []string{"icmp"}, From: []string{self}, To: []string{"any"}},
+				ruleset.Rule{Action: "pass", Dir: "out", On: on, From: []string{self}, To: []string{"any"}})
+			continue
+		}
+		r.Pass = append(r.Pass,
+			ruleset.Rule{Action: "pass", Dir: "in", Quick: true, On: on, Proto: udptcp, ToPort: []string{"53"}},
+			ruleset.Rule{Action: "pass", Dir: "out", On: on, From: []string{self}},
+			ruleset.Rule{Action: "pass", Dir: "in", On: on, AF: "inet", Proto: []string{"tcp"},
+				From: []string{"any"}, To: []string{self, "127.0.0.1"},
+				ToPort: []string{strconv.Itoa(d.CaptivePortalPort), strconv.Itoa(d.SubsPortalPort), "22", "667"}})
+		for _, port := range []string{"22", "9100", "9000"} {
+			r.Pass = append(r.Pass, ruleset.Rule{Action: "pass", Dir: "in", Quick: true, On: on, AF: "inet", Proto: []string{"tcp"},
+				From: []string{"any"}, To: []string{self}, ToPort: []string{port}, KeepState: true})
+		}
+		r.Pass = append(r.Pass,
+			ruleset.Rule{Action: "pass", Dir: "in", Quick: true, On: on, AF: "inet", Proto: []string{"udp"},
+				From: []string{"any"}, FromPort: []string{"bootpc"}, To: []string{"255.255.255.255"}, ToPort: []string{"bootps"}, KeepState: true},
+			ruleset.Rule{Action: "pass", Dir: "in", Quick: true, On: on, AF: "inet", Proto: []string{"udp"},
+				From: []string{"any"}, FromPort: []string{"bootpc"}, To: []string{self}, ToPort: []string{"bootps"}, KeepState: true},
+			ruleset.Rule{Action: "pass", Dir: "out", Quick: true, On: on, AF: "inet", Proto: []string{"udp"},
+				From: []string{self}, FromPort: []string{"bootps"}, To: []string{"any"}, ToPort: []string{"bootpc"}, KeepState: true})
+	}
+
+	// Vouchers get a queue and a tagging rule on every inside interface,
+	// subs only on the one named by their type. Both get a queue on every
+	// external interface that their tag selects for outgoing traffic.
+	for _, i := range d.Ifaces {
+		on := "$" + i.Name
+		for _, v := range d.Vouchers {
+			q := v.Value + i.Name
+			if i.Type == "external" {
+				r.SubQueues = append(r.SubQueues, ruleset.Queue{Name: q, Parent: i.Name,
+					Bandwidth: ruleset.Mbit(v.Upspeed), Min: "5M", Max: ruleset.Mbit(v.Upspeed)})
+				r.SubPass = append(r.SubPass, ruleset.Rule{Action: "pass", Dir: "out", On: on, Queue: []string{q}, Tagged: v.Value})
+				continue
+			}
+			r.SubQueues = append(r.SubQueues, ruleset.Queue{Name: q, Parent: i.Name,
+				Bandwidth: ruleset.Mbit(v.Downspeed), Min: "5M", Max: ruleset.Mbit(v.Downspeed),
+				Burst: ruleset.Mbit(v.Burstspeed), BurstFor: v.Duration})
+			r.SubPass = append(r.SubPass, ruleset.Rule{Action: "pass", Dir: "in", On: on, From: []string{v.Ip},
+				RouteTo: v.Gateway, Queue: []string{q}, Tag: v.Value})
+		}
+		for _, s := range d.Subs {
+			id := ident(s.Mac)
+			q := id + i.Name
+			if i.Type == "external" {
+				r.SubQueues = append(r.SubQueues, ruleset.Queue{Name: q, Parent: i.Name,
+					Bandwidth: ruleset.Mbit(s.Upspeed), Min: "5M", Max: ruleset.Mbit(s.Upspeed)})
+				r.SubPass = append(r.SubPass, ruleset.Rule{Action: "pass", Dir: "out", On: on, Queue: []string{q}, Prio: s.Priority, Tagged: id})
+				continue
+			}
+			if i.Name != s.Type {
+				continue
+			}
+			r.SubQueues = append(r.SubQueues, ruleset.Queue{Name: q, Parent: i.Name,
+				Bandwidth: ruleset.Mbit(s.Downspeed), Min: "5M", Max: ruleset.Mbit(s.Downspeed),
+				Burst: ruleset.Mbit(s.Burstspeed), BurstFor: s.Duration})
+			r.SubPass = append(r.SubPass, ruleset.Rule{Action: "pass", Dir: "in", On: on, From: []string{s.FramedIp},
+				RouteTo: s.Gateway, Queue: []string{q}, Prio: s.Priority, Tag: id})
+		}
+	}
+
+	if d.LoadBalance {
+		for _, g := range d.External {
+			for _, v := range d.External {
+				if v.Name != g.Name {
+					r.LoadBalance = append(r.LoadBalance, ruleset.Rule{Action: "pass", Dir: "out", On: "$" + g.Name,
+						From: []string{"$" + v.Name}, RouteTo: v.Gateway})
+				}
+			}
+		}
+	}
+	return r
+}
@@ -0,0 +1,171 @@
+package pfconfig
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rbaylon/arkgated/config/pf/ruleset"
+)
+
+// fixture is a router with two external interfaces, a wifi and a subs
+// network and a management port.
+func fixture() *TemplateData {
+	d := &TemplateData{
+		Router: "devopenbsd",
+		Ifaces: []Iface{
+			{Name: "wan1", Device: "em0", Speed: "100M", Type: "external", Default: true, Gateway: "10.0.0.1"},
+			{Name: "wan2", Device: "em1", Speed: "50M", Type: "external", Gateway: "10.0.1.1"},
+			{Name: "wifi", Device: "em2", Speed: "1G", Type: "internal"},
+			{Name: "subs", Device: "em3", Speed: "1G", Type: "internal"},
+			{Name: "management", Device: "em4", Speed: "1G", Type: "internal"},
+		},
+		DefaultIface:      "wan1",
+		AllowedFile:       "/var/arkgated/wifilist.txt",
+		SubsexprFile:      "/var/arkgated/subslist.txt",
+		SubsPortalPort:    8081,
+		CaptivePortalPort: 8080,
+		Vouchers: []Voucher{
+			{Value: "V1", Ip: "172.16.1.10", Downspeed: 10, Upspeed: 5, Burstspeed: 20, Duration: 500, Gateway: "10.0.0.1", Status: "active"},
+		},
+		Subs: []Sub{
+			{Mac: "AA:BB:CC:DD:EE:01", FramedIp: "172.16.2.1", Type: "subs", Downspeed: 30, Upspeed: 10, Burstspeed: 40, Duration: 1000,
+				Gateway: "10.0.1.1", Priority: 3, Status: "active"},
+		},
+	}
+	for _, i := range d.Ifaces {
+		if i.Type == "external" {
+			d.External = append(d.External, i)
+		}
+	}
+	return d
+}
+
+func lines[T fmt.Stringer](items []T) []string {
+	var out []string
+	for _, item := range items {
+		out = append(out, item.String())
+	}
+	return out
+}
+
+// wantLines fails unless got is want, line for line.
+func wantLines(t *testing.T, block string, got, want []string) {
+	t.Helper()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("%s:\n%s\nwant:\n%s", block, strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// wantSome fails unless every line of want is in got.
+func wantSome(t *testing.T, block string, got, want []string) {
+	t.Helper()
+	have := map[string]bool{}
+	for _, l := range got {
+		have[l] = true
+	}
+	for _, l := range want {
+		if !have[l] {
+			t.Errorf("%s lacks %q, got:\n%s", block, l, strings.Join(got, "\n"))
+		}
+	}
+}
+
+func TestBuildRulesStatic(t *testing.T) {
+	r := buildRules(fixture())
+	wantLines(t, "macros", lines(r.Macros), []string{
+		`wan1 = "em0"`, `wan2 = "em1"`, `wifi = "em2"`, `subs = "em3"`, `management = "em4"`,
+	})
+	wantLines(t, "tables", lines(r.Tables), []string{
+		`table <allowed> persist file "/var/arkgated/wifilist.txt"`,
+		`table <subsexpr> persist file "/var/arkgated/subslist.txt"`,
+		`table <bad_hosts> persist`,
+		`table <martians> { 0.0.0.0/8 169.254.0.0/16 192.0.0.0/24 192.0.2.0/24 224.0.0.0/3 198.18.0.0/15 198.51.100.0/24 203.0.113.0/24 }`,
+	})
+	wantSome(t, "queues", lines(r.Queues), []string{
+		`queue wan1 on $wan1 bandwidth 100M`,
+		`queue wan1def parent wan1 bandwidth 2M default`,
+		`queue selfq parent wan1 bandwidth 10M min 5M max 10M burst 15M for 100ms`,
+		`queue ssh_bulk parent apps bandwidth 5M max 5M`,
+	})
+	match := lines(r.Match)
+	wantSome(t, "match", match, []string{
+		`match out on $wan2 inet from !($wan2:network) to any nat-to ($wan2:0)`,
+		`match in on $wifi proto tcp from <subsexpr> to any port { 80, 443 } rdr-to 127.0.0.1 port 8081`,
+		`match in on $subs proto tcp from !<allowed> to any port { 80, 443 } rdr-to 127.0.0.1 port 8080`,
+		`match out on $management proto udp set prio 4`,
+	})
+	for _, l := range match {
+		if strings.Contains(l, "on $management") && strings.Contains(l, "rdr-to") {
+			t.Errorf("management is redirected to a portal: %s", l)
+		}
+	}
+	wantSome(t, "block", lines(r.Block), []string{
+		`block all`,
+		`block in quick from <bad_hosts>`,
+		`block return out on $wifi inet all set queue wifidef`,
+	})
+	wantSome(t, "pass", lines(r.Pass), []string{
+		`pass in on $wan1 inet proto tcp from any to $wan1:0 port 22 keep state (max-src-conn-rate 10/10, overload <bad_hosts> flush global) set queue (ssh_interactive, ssh_bulk)`,
+		`pass in on $subs inet proto tcp from any to { $subs:0, 127.0.0.1 } port { 8080, 8081, 22, 667 }`,
+	})
+	for _, l := range lines(r.Pass) {
+		if strings.Contains(l, "on $wan2") && strings.Contains(l, "port 22") {
+			t.Errorf("ssh passed on the non default external interface: %s", l)
+		}
+	}
+}
+
+func TestBuildRulesSubs(t *testing.T) {
+	r := buildRules(fixture())
+	wantLines(t, "subqueues", lines(r.SubQueues), []string{
+		`queue V1wan1 parent wan1 bandwidth 5M min 5M max 5M`,
+		`queue AABBCCDDEE01wan1 parent wan1 bandwidth 10M min 5M max 10M`,
+		`queue V1wan2 parent wan2 bandwidth 5M min 5M max 5M`,
+		`queue AABBCCDDEE01wan2 parent wan2 bandwidth 10M min 5M max 10M`,
+		`queue V1wifi parent wifi bandwidth 10M min 5M max 10M burst 20M for 500ms`,
+		`queue V1subs parent subs bandwidth 10M min 5M max 10M burst 20M for 500ms`,
+		`queue AABBCCDDEE01subs parent subs bandwidth 30M min 5M max 30M burst 40M for 1000ms`,
+		`queue V1management parent management bandwidth 10M min 5M max 10M burst 20M for 500ms`,
+	})
+	wantLines(t, "subpass", lines(r.SubPass), []string{
+		`pass out on $wan1 set queue V1wan1 tagged "V1"`,
+		`pass out on $wan1 set queue AABBCCDDEE01wan1 set prio 3 tagged "AABBCCDDEE01"`,
+		`pass out on $wan2 set queue V1wan2 tagged "V1"`,
+		`pass out on $wan2 set queue AABBCCDDEE01wan2 set prio 3 tagged "AABBCCDDEE01"`,
+		`pass in on $wifi from 172.16.1.10 route-to 10.0.0.1 set queue V1wifi tag "V1"`,
+		`pass in on $subs from 172.16.1.10 route-to 10.0.0.1 set queue V1subs tag "V1"`,
+		`pass in on $subs from 172.16.2.1 route-to 10.0.1.1 set queue AABBCCDDEE01subs set prio 3 tag "AABBCCDDEE01"`,
+		`pass in on $management from 172.16.1.10 route-to 10.0.0.1 set queue V1management tag "V1"`,
+	})
+	if len(r.LoadBalance) != 0 {
+		t.Errorf("load balancing rules without load_balance: %q", lines(r.LoadBalance))
+	}
+}
+
+func TestBuildRulesNoSubs(t *testing.T) {
+	d := fixture()
+	d.Vouchers, d.Subs = nil, nil
+	r := buildRules(d)
+	if len(r.SubQueues) != 0 || len(r.SubPass) != 0 {
+		t.Errorf("sub rules without subs: %q %q", lines(r.SubQueues), lines(r.SubPass))
+	}
+	// The rest of the ruleset does not depend on the subs.
+	full := buildRules(fixture())
+	for _, block := range []struct {
+		name      string
+		got, want []ruleset.Rule
+	}{{"match", r.Match, full.Match}, {"block", r.Block, full.Block}, {"pass", r.Pass, full.Pass}} {
+		wantLines(t, block.name, lines(block.got), lines(block.want))
+	}
+	wantLines(t, "queues", lines(r.Queues), lines(full.Queues))
+}
+
+func TestBuildRulesLoadBalance(t *testing.T) {
+	d := fixture()
+	d.LoadBalance = true
+	wantLines(t, "loadbalance", lines(buildRules(d).LoadBalance), []string{
+		`pass out on $wan1 from $wan2 route-to 10.0.1.1`,
+		`pass out on $wan2 from $wan1 route-to 10.0.0.1`,
+	})
+}
@@ -0,0 +1,213 @@
+// Package ruleset models the parts of pf.conf arkgated generates. Every
+// type renders itself as one canonical pf.conf line with String, which is
+// how the pf.conf template prints them.
+package ruleset
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Macro is name = "value".
+type Macro struct {
+	Name  string
+	Value string
+}
+
+func (m Macro) String() string {
+	return fmt.Sprintf("%s = \"%s\"", m.Name, m.Value)
+}
+
+// Table declares a table, loaded from File and/or holding Addrs.
+type Table struct {
+	Name    string
+	Persist bool
+	File    string
+	Addrs   []string
+}
+
+func (t Table) String() string {
+	s := "table <" + t.Name + ">"
+	if t.Persist {
+		s += " persist"
+	}
+	if t.File != "" {
+		s += " file \"" + t.File + "\""
+	}
+	if len(t.Addrs) > 0 {
+		s += " { " + strings.Join(t.Addrs, " ") + " }"
+	}
+	return s
+}
+
+// Option is a set line, such as set block-policy drop.
+type Option struct {
+	Name  string
+	Value string
+}
+
+func (o Option) String() string {
+	return "set " + o.Name + " " + o.Value
+}
+
+// Queue is a root queue when On is set, otherwise a child of Parent.
+// Bandwidths are pf values such as 10M, BurstFor is in milliseconds.
+type Queue struct {
+	Name      string
+	On        string
+	Parent    string
+	Bandwidth string
+	Min       string
+	Max       string
+	Burst     string
+	BurstFor  int
+	Default   bool
+}
+
+func (q Queue) String() string {
+	s := "queue " + q.Name
+	if q.On != "" {
+		s += " on " + q.On
+	}
+	if q.Parent != "" {
+		s += " parent " + q.Parent
+	}
+	s += " bandwidth " + q.Bandwidth
+	if q.Min != "" {
+		s += " min " + q.Min
+	}
+	if q.Max != "" {
+		s += " max " + q.Max
+	}
+	if q.Burst != "" {
+		s += " burst " + q.Burst + " for " + strconv.Itoa(q.BurstFor) + "ms"
+	}
+	if q.Default {
+		s += " default"
+	}
+	return s
+}
+
+// Mbit formats n as a bandwidth in megabits.
+func Mbit(n int) string {
+	return strconv.Itoa(n) + "M"
+}
+
+// Rule is a match, block or pass rule. Hosts and ports are pf values, an
+// empty From or To with no port is left out. Lists get braces.
+type Rule struct {
+	// Action is "match", "block" or "pass".
+	Action string
+	Return bool
+	// Dir is "in", "out" or empty for both.
+	Dir   string
+	Quick bool
+	On    string
+	AF    string
+	Proto []string
+	// All is rendered instead of the hosts.
+	All      bool
+	From     []string
+	FromPort []string
+	To       []string
+	ToPort   []string
+
+	RouteTo string
+	NatTo   string
+	RdrTo   string
+	Scrub   string
+	// KeepState is rendered with StateOpts, if any, in parentheses.
+	KeepState bool
+	StateOpts string
+	// Queue holds one queue, or the queue and the one for lowdelay and
+	// ack packets.
+	Queue  []string
+	Prio   int
+	Tag    string
+	Tagged string
+}
+
+func (r Rule) String() string {
+	parts := []string{r.Action}
+	if r.Return {
+		parts = append(parts, "return")
+	}
+	if r.Dir != "" {
+		parts = append(parts, r.Dir)
+	}
+	if r.Quick {
+		parts = append(parts, "quick")
+	}
+	if r.On != "" {
+		parts = append(parts, "on", r.On)
+	}
+	if r.AF != "" {
+		parts = append(parts, r.AF)
+	}
+	if len(r.Proto) > 0 {
+		parts = append(parts, "proto", list(r.Proto))
+	}
+	if r.All {
+		parts = append(parts, "all")
+	} else {
+		parts = append(parts, hosts("from", r.From, r.FromPort)...)
+		parts = append(parts, hosts("to", r.To, r.ToPort)...)
+	}
+	if r.RouteTo != "" {
+		parts = append(parts, "route-to", r.RouteTo)
+	}
+	if r.NatTo != "" {
+		parts = append(parts, "nat-to", r.NatTo)
+	}
+	if r.RdrTo != "" {
+		parts = append(parts, "rdr-to", r.RdrTo)
+	}
+	if r.Scrub != "" {
+		parts = append(parts, "scrub", r.Scrub)
+	}
+	if r.KeepState {
+		parts = append(parts, "keep state")
+		if r.StateOpts != "" {
+			parts = append(parts, "("+r.StateOpts+")")
+		}
+	}
+	switch len(r.Queue) {
+	case 0:
+	case 1:
+		parts = append(parts, "set queue", r.Queue[0])
+	default:
+		parts = append(parts, "set queue", "("+strings.Join(r.Queue, ", ")+")")
+	}
+	if r.Prio > 0 {
+		parts = append(parts, "set prio", strconv.Itoa(r.Prio))
+	}
+	if r.Tag != "" {
+		parts = append(parts, "tag", "\""+r.Tag+"\"")
+	}
+	if r.Tagged != "" {
+		parts = append(parts, "tagged", "\""+r.Tagged+"\"")
+	}
+	return strings.Join(parts, " ")
+}
+
+func hosts(dir string, addrs, ports []string) []string {
+	if len(addrs) == 0 && len(ports) == 0 {
+		return nil
+	}
+	parts := []string{dir, "any"}
+	if len(addrs) > 0 {
+		parts[1] = list(addrs)
+	}
+	if len(ports) > 0 {
+		parts = append(parts, "port", list(ports))
+	}
+	return parts
+}
+
+func list(items []string) string {
+	if len(items) == 1 {
+		return items[0]
+	}
+	return "{ " + strings.Join(items, ", ") + " }"
+}
@@ -0,0 +1,101 @@
+package pfconfig
+
+import (
+	"embed"
+	"errors"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// TemplateFile is the name of the pf.conf template. The default is built
+// in, a file by this name in rundir overrides it.
+const TemplateFile = "pf.conf.tmpl"
+
+//go:embed templates/pf.conf.tmpl
+var templates embed.FS
+
+// TemplateData is what the pf.conf template is executed with.
+type TemplateData struct {
+	Router string
+	// Ifaces are those of config.json in order, External the ones of type
+	// external. DefaultIface is the name of the default interface.
+	Ifaces       []Iface
+	External     []Iface
+	DefaultIface string
+	// AllowedFile and SubsexprFile are the paths of the files backing the
+	// allowed and subsexpr tables.
+	AllowedFile       string
+	SubsexprFile      string
+	SubsPortalPort    int
+	CaptivePortalPort int
+	LoadBalance       bool
+	// Vouchers and Subs are the active ones fetched from the api.
+	Vouchers []Voucher
+	Subs     []Sub
+	// Rules is the default policy for all of the above.
+	Rules *Rules
+}
+
+var templateFuncs = template.FuncMap{
+	"ident": ident,
+	"lower": strings.ToLower,
+}
+
+// LoadTemplate returns the built in pf.conf template with rundir's
+// pf.conf.tmpl, if there is one, parsed on top. The site template can
+// replace the whole file or only redefine some of the named blocks of the
+// default, such as "pass" or "subqueues".
+func LoadTemplate(rundir string) (*template.Template, error) {
+	t, err := template.New(TemplateFile).Funcs(templateFuncs).ParseFS(templates, "templates/"+TemplateFile)
+	if err != nil {
+		return nil, err
+	}
+	site, err := os.ReadFile(rundir + TemplateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A site template made only of define blocks leaves the body of the
+	// default in place, any other replaces it under the same name.
+	if _, err := t.New(TemplateFile).Parse(string(site)); err != nil {
+		return nil, err
+	}
+	return t.Lookup(TemplateFile), nil
+}
+
+// templateData collects what the template needs from c and the vouchers
+// and subs in subs.
+func (c *PfConfig) templateData(rundir string, subs *PfConfig) *TemplateData {
+	d := &TemplateData{
+		Router:            c.Router,
+		Ifaces:            c.Ifaces,
+		AllowedFile:       rundir + c.WifiIpList,
+		SubsexprFile:      rundir + c.SubsIpList,
+		SubsPortalPort:    c.SubsPortalPort,
+		CaptivePortalPort: c.CaptivePortalPort,
+		LoadBalance:       c.LoadBalance,
+	}
+	for _, i := range c.Ifaces {
+		if i.Type == "external" {
+			d.External = append(d.External, i)
+		}
+		if i.Default {
+			d.DefaultIface = i.Name
+		}
+	}
+	for _, v := range subs.Vouchers {
+		if v.Status == "active" {
+			d.Vouchers = append(d.Vouchers, v)
+		}
+	}
+	for _, s := range subs.Subs {
+		if s.Status == "active" {
+			d.Subs = append(d.Subs, s)
+		}
+	}
+	d.Rules = buildRules(d)
+	return d
+}
@@ -0,0 +1,85 @@
+package pfconfig
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// render executes the template loaded from rundir with the fixture.
+func render(t *testing.T, rundir string) string {
+	t.Helper()
+	tmpl, err := LoadTemplate(rundir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := fixture()
+	d.Rules = buildRules(d)
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, d); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// siteTemplate returns a rundir holding text as pf.conf.tmpl.
+func siteTemplate(t *testing.T, text string) string {
+	t.Helper()
+	dir := t.TempDir() + "/"
+	if err := os.WriteFile(dir+TemplateFile, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLoadTemplateDefineOnly(t *testing.T) {
+	def := render(t, t.TempDir()+"/")
+	got := render(t, siteTemplate(t, `{{define "pass"}}pass quick all # site{{"\n"}}{{end}}`))
+	rules := buildRules(fixture())
+	if !strings.Contains(got, "pass quick all # site\n") {
+		t.Errorf("site pass block missing:\n%s", got)
+	}
+	for _, l := range lines(rules.Pass) {
+		if strings.Contains(got, l+"\n") {
+			t.Errorf("default pass rule %q kept", l)
+		}
+	}
+	// Everything but the pass block is the default's.
+	for _, block := range [][]string{lines(rules.Tables), lines(rules.Block), lines(rules.SubPass)} {
+		for _, l := range block {
+			if !strings.Contains(def, l+"\n") || !strings.Contains(got, l+"\n") {
+				t.Errorf("rule %q missing", l)
+			}
+		}
+	}
+}
+
+func TestLoadTemplateFullOverride(t *testing.T) {
+	got := render(t, siteTemplate(t, "# {{.Router}}\npass all\n"))
+	if want := "# devopenbsd\npass all\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCreateTemplateError(t *testing.T) {
+	s := newStub(t)
+	c := &PfConfig{Router: "devopenbsd", Ifaces: fixture().Ifaces, WifiIpList: "wifilist.txt", SubsIpList: "subslist.txt"}
+	if _, err := c.Create(context.Background(), s.dir, &PfConfig{}, s); err != nil {
+		t.Fatal(err)
+	}
+	s.calls()
+	if err := os.WriteFile(s.dir+TemplateFile, []byte(`{{define "pass"}}pass all`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before := s.state()
+	if _, err := c.Create(context.Background(), s.dir, &PfConfig{}, s); err == nil {
+		t.Fatal("Create succeeded with an unterminated define")
+	}
+	if after := s.state(); !reflect.DeepEqual(before, after) {
+		t.Errorf("files changed:\n%v\nwant:\n%v", after, before)
+	}
+	wantCalls(t, s.calls())
+}
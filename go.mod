@@ -5,4 +5,5 @@ go 1.21.1
 require (
 	github.com/MakeNowJust/heredoc v1.0.0
 	github.com/namsral/flag v1.7.4-pre
+	golang.org/x/sync v0.6.0
 )
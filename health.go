@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	pfconfig "github.com/rbaylon/arkgated/config/pf"
+	"github.com/rbaylon/arkgated/ipc"
+)
+
+// health remembers the outcome of enrollment and pf config generation for
+// the status request.
+type health struct {
+	mu          sync.Mutex
+	enrolled    bool
+	enrollErr   string
+	lastSync    time.Time
+	lastFailure time.Time
+	syncErr     string
+	summary     *pfconfig.Summary
+}
+
+func (h *health) enroll(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.enrolled = err == nil
+	h.enrollErr = ""
+	if err != nil {
+		h.enrollErr = err.Error()
+	}
+}
+
+func (h *health) sync(sum *pfconfig.Summary, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.lastFailure = time.Now()
+		h.syncErr = err.Error()
+		return
+	}
+	h.lastSync = time.Now()
+	h.summary = sum
+}
+
+// fill copies what h knows into st.
+func (h *health) fill(st *ipc.Status) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st.Enrolled = h.enrolled
+	st.EnrollError = h.enrollErr
+	if !h.lastSync.IsZero() {
+		t := h.lastSync
+		st.LastSync = &t
+	}
+	if !h.lastFailure.IsZero() {
+		t := h.lastFailure
+		st.LastSyncFailure = &t
+		st.SyncError = h.syncErr
+	}
+	if h.summary != nil {
+		st.PfConfHash = h.summary.PfConfHash
+		st.Vouchers = h.summary.Vouchers
+		st.Subs = h.summary.Subs
+	}
+}
+
+// tokenExpiry returns the exp claim of a JWT. ok is false when the token
+// is not a JWT or has no expiry. The signature is not checked, the api
+// does that.
+func tokenExpiry(token string) (exp time.Time, ok bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp *float64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(*claims.Exp), 0), true
+}
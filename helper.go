@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/rbaylon/arkgated/privsep"
+)
+
+// privsepEnv marks the unprivileged child of a privilege separated daemon.
+// The child finds the privsep socket and the IPC listener at these fds.
+const (
+	privsepEnv = "ARKGATED_PRIVSEP"
+	privsepFd  = 3
+	listenFd   = 4
+)
+
+// runPrivileged is the root side of privilege separation. It creates the
+// IPC socket, starts arkgated again as c.user with the socket and one end
+// of a socketpair, and serves the privileged operations the child asks for
+// until the child exits.
+func runPrivileged(c *config) int {
+	u, err := user.Lookup(c.user)
+	if err != nil {
+		slog.Error("privsep: unknown user", "user", c.user, "err", err)
+		return 1
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	if uid == 0 {
+		slog.Error("-user must not be root")
+		return 1
+	}
+
+	h := privsep.NewHelper()
+	if err := h.Load(c.cmdfile, c.rundir, c.pfconf); err != nil {
+		slog.Error("privsep: unable to load", "err", err)
+		return 1
+	}
+	ln, _, err := openListener(c)
+	if err != nil {
+		slog.Error("Unable to listen", "socket", c.sockfile, "err", err)
+		return 1
+	}
+	defer ln.Close()
+	lnf, err := ln.(interface{ File() (*os.File, error) }).File()
+	if err != nil {
+		slog.Error("privsep", "err", err)
+		return 1
+	}
+	conn, childEnd, err := privsep.Socketpair()
+	if err != nil {
+		slog.Error("privsep", "err", err)
+		return 1
+	}
+	defer conn.Close()
+
+	self, err := os.Executable()
+	if err != nil {
+		slog.Error("privsep", "err", err)
+		return 1
+	}
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), privsepEnv+"=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{childEnd, lnf}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+	}
+	err = cmd.Start()
+	childEnd.Close()
+	lnf.Close()
+	if err != nil {
+		slog.Error("privsep: unable to start child", "err", err)
+		return 1
+	}
+	slog.Info("privsep: serving child", "pid", cmd.Process.Pid, "user", c.user)
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for s := range sigchan {
+			if s == syscall.SIGHUP {
+				// Flags may come from a config file that changed as
+				// well, the helper follows what the child will load.
+				nc := &config{}
+				if err := nc.init(c.args); err != nil {
+					slog.Error("privsep: reload failed", "err", err)
+				} else {
+					if err := h.Load(nc.cmdfile, nc.rundir, nc.pfconf); err != nil {
+						slog.Error("privsep: reload failed", "err", err)
+					}
+					if err := setupLogging(nc, os.Stderr); err != nil {
+						slog.Error("privsep: reopening log failed", "err", err)
+					}
+				}
+			}
+			cmd.Process.Signal(s)
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := h.Serve(ctx, conn)
+		if err != nil && err != io.EOF && !errors.Is(err, net.ErrClosed) {
+			slog.Error("privsep", "err", err)
+		}
+	}()
+
+	err = cmd.Wait()
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		return exiterr.ExitCode()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// privsepChild returns the IPC listener and helper client handed down by
+// runPrivileged.
+func privsepChild() (net.Listener, *privsep.Client, error) {
+	conn, err := net.FileConn(os.NewFile(privsepFd, "privsep"))
+	if err != nil {
+		return nil, nil, err
+	}
+	ln, err := net.FileListener(os.NewFile(listenFd, "listener"))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return ln, privsep.NewClient(conn), nil
+}
@@ -0,0 +1,88 @@
+package ipc
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Every message on the socket is a JSON document preceded by its length as
+// a 4 byte big endian integer. A connection may carry any number of
+// messages, responses are written in the order the requests were read.
+const headerLen = 4
+
+// MaxLimit is the largest frame ReadMsg ever accepts, whatever limit it is
+// given, so that a header alone can not make it allocate gigabytes.
+const MaxLimit = 64 * 1024 * 1024
+
+// TooLargeError is returned by ReadMsg when a frame exceeds the limit. The
+// frame body has been discarded so the next message can still be read.
+type TooLargeError struct {
+	Size  uint32
+	Limit int
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("message of %d bytes exceeds limit of %d", e.Size, e.Limit)
+}
+
+// DecodeError is returned by ReadMsg when a complete frame was read but its
+// body is not valid JSON for v.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return e.Err.Error()
+}
+
+// ReadMsg reads one frame of at most max bytes from r and decodes it into
+// v. A max of zero or above MaxLimit means MaxLimit. io.EOF is returned
+// untouched when r ends cleanly between frames.
+func ReadMsg(r io.Reader, max int, v any) error {
+	if max <= 0 || max > MaxLimit {
+		max = MaxLimit
+	}
+	var hdr [headerLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if uint64(size) > uint64(max) {
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		return &TooLargeError{Size: size, Limit: max}
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return &DecodeError{Err: err}
+	}
+	return nil
+}
+
+// WriteMsg encodes v and writes it to w as a single frame.
+func WriteMsg(w io.Writer, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if uint64(len(body)) > uint64(^uint32(0)) {
+		return fmt.Errorf("message of %d bytes is too large to frame", len(body))
+	}
+	msg := make([]byte, headerLen+len(body))
+	binary.BigEndian.PutUint32(msg, uint32(len(body)))
+	copy(msg[headerLen:], body)
+	_, err = w.Write(msg)
+	return err
+}
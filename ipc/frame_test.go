@@ -0,0 +1,138 @@
+package ipc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func frame(body string) []byte {
+	msg := make([]byte, headerLen+len(body))
+	binary.BigEndian.PutUint32(msg, uint32(len(body)))
+	copy(msg[headerLen:], body)
+	return msg
+}
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	for _, name := range []string{"CheckPF", "TESTPF", "KILLSTATES"} {
+		if err := WriteMsg(&buf, &Request{Version: Version, Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"CheckPF", "TESTPF", "KILLSTATES"} {
+		var req Request
+		if err := ReadMsg(&buf, 1024, &req); err != nil {
+			t.Fatal(err)
+		}
+		if req.Name != want {
+			t.Fatalf("got %q, want %q", req.Name, want)
+		}
+	}
+	var req Request
+	if err := ReadMsg(&buf, 1024, &req); err != io.EOF {
+		t.Fatalf("err = %v at the end, want io.EOF", err)
+	}
+}
+
+func TestTooLargeStaysInSync(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(frame(`{"name":"` + strings.Repeat("x", 100) + `"}`))
+	buf.Write(frame(`{"name":"next"}`))
+	var req Request
+	err := ReadMsg(&buf, 64, &req)
+	var tl *TooLargeError
+	if !errors.As(err, &tl) || tl.Size != 111 || tl.Limit != 64 {
+		t.Fatalf("err = %v, want TooLargeError of 111 bytes", err)
+	}
+	if err := ReadMsg(&buf, 64, &req); err != nil || req.Name != "next" {
+		t.Fatalf("after an oversized frame: req = %+v, err = %v", req, err)
+	}
+}
+
+func TestHardLimit(t *testing.T) {
+	for _, max := range []int{0, -1, MaxLimit * 2} {
+		var hdr [headerLen]byte
+		binary.BigEndian.PutUint32(hdr[:], MaxLimit+1)
+		r := io.MultiReader(bytes.NewReader(hdr[:]), io.LimitReader(zeros{}, MaxLimit+1))
+		var req Request
+		err := ReadMsg(r, max, &req)
+		var tl *TooLargeError
+		if !errors.As(err, &tl) || tl.Limit != MaxLimit {
+			t.Fatalf("max %d: err = %v, want TooLargeError with limit %d", max, err, MaxLimit)
+		}
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestTruncated(t *testing.T) {
+	full := frame(`{"name":"CheckPF"}`)
+	tests := []struct {
+		name string
+		data []byte
+		max  int
+		want error
+	}{
+		{"empty", nil, 1024, io.EOF},
+		{"short header", full[:2], 1024, io.ErrUnexpectedEOF},
+		{"eof in body", full[:len(full)-3], 1024, io.ErrUnexpectedEOF},
+		{"eof in oversized body", full[:len(full)-3], 4, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		var req Request
+		if err := ReadMsg(bytes.NewReader(tt.data), tt.max, &req); err != tt.want {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(frame(`{"name":`))
+	buf.Write(frame(`{"name":"next"}`))
+	var req Request
+	var de *DecodeError
+	if err := ReadMsg(&buf, 1024, &req); !errors.As(err, &de) {
+		t.Fatalf("err = %v, want DecodeError", err)
+	}
+	if err := ReadMsg(&buf, 1024, &req); err != nil || req.Name != "next" {
+		t.Fatalf("after a bad frame: req = %+v, err = %v", req, err)
+	}
+}
+
+func TestConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		for i := 0; i < 3; i++ {
+			WriteMsg(a, &Response{Version: Version, ID: string(rune('a' + i)), OK: true})
+		}
+		a.Close()
+	}()
+	r := bufio.NewReader(b)
+	for _, want := range []string{"a", "b", "c"} {
+		var resp Response
+		if err := ReadMsg(r, 1024, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ID != want {
+			t.Fatalf("got reply %q, want %q", resp.ID, want)
+		}
+	}
+	var resp Response
+	if err := ReadMsg(r, 1024, &resp); err != io.EOF {
+		t.Fatalf("err = %v after the writer closed, want io.EOF", err)
+	}
+}
@@ -0,0 +1,162 @@
+// Package ipc defines the messages exchanged with arkgated over its unix
+// socket.
+package ipc
+
+import (
+	"fmt"
+	"time"
+)
+
+// Version is the protocol version spoken by this daemon. Requests without
+// a version are treated as the current one.
+const Version = 1
+
+// Error codes returned in Response.Error.Code.
+const (
+	ErrBadRequest         = "bad_request"
+	ErrTooLarge           = "too_large"
+	ErrUnsupportedVersion = "unsupported_version"
+	ErrUnknownCommand     = "unknown_command"
+	ErrInvalidArgs        = "invalid_args"
+	ErrPermissionDenied   = "permission_denied"
+	ErrRegenFailed        = "regen_failed"
+	ErrExecFailed         = "exec_failed"
+	ErrNonZeroExit        = "nonzero_exit"
+	ErrTimeout            = "timeout"
+	ErrCanceled           = "canceled"
+	ErrUnknownJob         = "unknown_job"
+	ErrBusy               = "busy"
+	ErrShuttingDown       = "shutting_down"
+	ErrInternal           = "internal"
+)
+
+// Built in requests handled by the daemon itself rather than the command
+// file. They take the job id in Args["id"], JobWait also accepts a
+// timeout in seconds in Args["timeout"].
+const (
+	JobStatusCmd = "job.status"
+	JobWaitCmd   = "job.wait"
+	JobCancelCmd = "job.cancel"
+	// ListCmd replies with the commands the caller may run.
+	ListCmd = "commands.list"
+	// StatusCmd replies with the daemon status.
+	StatusCmd = "status"
+)
+
+type Request struct {
+	Version int               `json:"version"`
+	ID      string            `json:"id,omitempty"`
+	Name    string            `json:"name"`
+	Args    map[string]string `json:"args,omitempty"`
+	// Async makes the daemon reply with a job as soon as the command is
+	// started instead of when it finishes.
+	Async bool `json:"async,omitempty"`
+	// Stream makes the daemon send each output line as its own response,
+	// with Output set, ahead of the final response.
+	Stream bool `json:"stream,omitempty"`
+}
+
+// Output is a single line of command output sent while streaming.
+type Output struct {
+	Stream string `json:"stream"`
+	Line   string `json:"line"`
+}
+
+// Job states.
+const (
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+// JobStatus describes a command started with Request.Async. Result is set
+// once the job is no longer running.
+type JobStatus struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	State    string     `json:"state"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Result   *Response  `json:"result,omitempty"`
+}
+
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+type Response struct {
+	Version   int    `json:"version"`
+	ID        string `json:"id,omitempty"`
+	OK        bool   `json:"ok"`
+	ExitCode  int    `json:"exit_code"`
+	Stdout    string `json:"stdout,omitempty"`
+	Stderr    string `json:"stderr,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	// Regenerated is set when the pf config was rebuilt for the request,
+	// Diff is then the unified diff of the generated files that changed.
+	Regenerated bool          `json:"regenerated,omitempty"`
+	Diff        string        `json:"diff,omitempty"`
+	DurationMs  int64         `json:"duration_ms"`
+	Error       *Error        `json:"error,omitempty"`
+	Job         *JobStatus    `json:"job,omitempty"`
+	Commands    []CommandInfo `json:"commands,omitempty"`
+	Status      *Status       `json:"status,omitempty"`
+	// Output is only set on the intermediate responses of a streamed
+	// request, the final response never carries it.
+	Output *Output `json:"output,omitempty"`
+}
+
+// NewError builds a failed response for req.
+func NewError(req *Request, code string, err error) *Response {
+	resp := &Response{Version: Version, ExitCode: -1, Error: &Error{Code: code, Message: err.Error()}}
+	if req != nil {
+		resp.ID = req.ID
+	}
+	return resp
+}
+
+// CommandInfo describes an allowlisted command in reply to ListCmd.
+type CommandInfo struct {
+	Name   string      `json:"name"`
+	Params []ParamInfo `json:"params,omitempty"`
+}
+
+type ParamInfo struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Values []string `json:"values,omitempty"`
+}
+
+// Status is the reply to StatusCmd.
+type Status struct {
+	Version string    `json:"version"`
+	Started time.Time `json:"started"`
+	Uptime  int64     `json:"uptime_seconds"`
+	Router  string    `json:"router"`
+	// Enrolled is set once the router is known to the service manager.
+	Enrolled    bool   `json:"enrolled"`
+	EnrollError string `json:"enroll_error,omitempty"`
+	// TokenValid is set when there is an api token that has not expired.
+	// TokenExpires is nil when the token carries no expiry.
+	TokenValid   bool       `json:"token_valid"`
+	TokenExpires *time.Time `json:"token_expires,omitempty"`
+	// LastSync and LastSyncFailure are the times of the last successful
+	// and failed pf config generations, SyncError the error of the latter.
+	LastSync        *time.Time `json:"last_sync,omitempty"`
+	LastSyncFailure *time.Time `json:"last_sync_failure,omitempty"`
+	SyncError       string     `json:"sync_error,omitempty"`
+	// PfConfHash is the hex sha256 of the pf.conf installed last.
+	PfConfHash string `json:"pfconf_sha256,omitempty"`
+	Vouchers   int    `json:"active_vouchers"`
+	Subs       int    `json:"active_subs"`
+	// Queued counts commands waiting for their turn, Running those
+	// executing.
+	Queued  int64 `json:"queued"`
+	Running int64 `json:"running"`
+}
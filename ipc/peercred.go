@@ -0,0 +1,35 @@
+package ipc
+
+import (
+	"fmt"
+	"net"
+)
+
+// Cred identifies the process on the other end of a unix socket.
+type Cred struct {
+	Uid int `json:"uid"`
+	Gid int `json:"gid"`
+	Pid int `json:"pid"`
+}
+
+// PeerCred returns the credentials of the process connected to conn as
+// reported by the kernel through SO_PEERCRED.
+func PeerCred(conn net.Conn) (*Cred, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("peer credentials need a unix socket, got %T", conn)
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *Cred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = getPeerCred(int(fd))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
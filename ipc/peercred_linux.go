@@ -0,0 +1,11 @@
+package ipc
+
+import "syscall"
+
+func getPeerCred(fd int) (*Cred, error) {
+	uc, err := syscall.GetsockoptUcred(fd, syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return nil, err
+	}
+	return &Cred{Uid: int(uc.Uid), Gid: int(uc.Gid), Pid: int(uc.Pid)}, nil
+}
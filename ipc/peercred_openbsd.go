@@ -0,0 +1,41 @@
+//go:build openbsd && !mips64
+
+package ipc
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// sockpeercred mirrors struct sockpeercred from sys/socket.h.
+type sockpeercred struct {
+	Uid uint32
+	Gid uint32
+	Pid int32
+}
+
+// OpenBSD only allows system calls from libc, so getsockopt is called
+// there through a trampoline the way golang.org/x/sys/unix does it. The
+// syscall package has no exported getsockopt for a struct.
+
+//go:cgo_import_dynamic libc_getsockopt getsockopt "libc.so"
+
+var libc_getsockopt_trampoline_addr uintptr
+
+// syscall_syscall6 calls a libc function, it is implemented in the
+// runtime.
+//
+//go:linkname syscall_syscall6 syscall.syscall6
+func syscall_syscall6(fn, a1, a2, a3, a4, a5, a6 uintptr) (r1, r2 uintptr, err syscall.Errno)
+
+func getPeerCred(fd int) (*Cred, error) {
+	var pc sockpeercred
+	size := uint32(unsafe.Sizeof(pc))
+	_, _, errno := syscall_syscall6(libc_getsockopt_trampoline_addr, uintptr(fd),
+		syscall.SOL_SOCKET, syscall.SO_PEERCRED,
+		uintptr(unsafe.Pointer(&pc)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	return &Cred{Uid: int(pc.Uid), Gid: int(pc.Gid), Pid: int(pc.Pid)}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux && (!openbsd || mips64)
+
+package ipc
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func getPeerCred(fd int) (*Cred, error) {
+	return nil, fmt.Errorf("peer credentials are not supported on %s", runtime.GOOS)
+}
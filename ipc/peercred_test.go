@@ -0,0 +1,61 @@
+//go:build linux || openbsd
+
+package ipc
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// socketpair returns both ends of a connected unix socket pair.
+func socketpair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func TestPeerCred(t *testing.T) {
+	a, b := socketpair(t)
+	for _, conn := range []net.Conn{a, b} {
+		cred, err := PeerCred(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Cred{Uid: os.Getuid(), Gid: os.Getgid(), Pid: os.Getpid()}
+		if *cred != want {
+			t.Fatalf("cred = %+v, want %+v", *cred, want)
+		}
+	}
+}
+
+func TestPeerCredNotUnix(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if cred, err := PeerCred(a); err == nil {
+		t.Fatalf("cred = %+v from a pipe, want an error", *cred)
+	}
+}
+
+func TestPeerCredClosed(t *testing.T) {
+	a, _ := socketpair(t)
+	a.Close()
+	if cred, err := PeerCred(a); err == nil {
+		t.Fatalf("cred = %+v from a closed socket, want an error", *cred)
+	}
+}
@@ -0,0 +1,147 @@
+// Package jobs keeps track of commands that run in the background on
+// behalf of IPC clients.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rbaylon/arkgated/ipc"
+)
+
+// ErrFull is returned by Start when every slot holds a job that has not
+// finished yet.
+var ErrFull = fmt.Errorf("job table full")
+
+type job struct {
+	status ipc.JobStatus
+	owner  int
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Table is a bounded set of jobs. Once full, the oldest finished job is
+// forgotten to make room for a new one.
+type Table struct {
+	mu    sync.Mutex
+	max   int
+	jobs  map[string]*job
+	order []string
+}
+
+func NewTable(max int) *Table {
+	return &Table{max: max, jobs: map[string]*job{}}
+}
+
+// Start runs fn in the background under ctx and returns its initial status.
+// owner is the uid of the client that started the job, fn is passed the id
+// of the job it runs for.
+func (t *Table) Start(ctx context.Context, name string, owner int, fn func(ctx context.Context, id string) *ipc.Response) (ipc.JobStatus, error) {
+	id, err := newID()
+	if err != nil {
+		return ipc.JobStatus{}, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.order) >= t.max && !t.evict() {
+		return ipc.JobStatus{}, ErrFull
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	j := &job{
+		status: ipc.JobStatus{ID: id, Name: name, State: ipc.JobRunning, Started: time.Now()},
+		owner:  owner,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	t.jobs[id] = j
+	t.order = append(t.order, id)
+	go func() {
+		defer cancel()
+		resp := fn(ctx, id)
+		t.mu.Lock()
+		finished := time.Now()
+		j.status.Finished = &finished
+		j.status.Result = resp
+		switch {
+		case resp.OK:
+			j.status.State = ipc.JobDone
+		case ctx.Err() == context.Canceled:
+			j.status.State = ipc.JobCanceled
+		default:
+			j.status.State = ipc.JobFailed
+		}
+		t.mu.Unlock()
+		close(j.done)
+	}()
+	return j.status, nil
+}
+
+// evict drops the oldest finished job. Called with t.mu held.
+func (t *Table) evict() bool {
+	for i, id := range t.order {
+		if t.jobs[id].status.State != ipc.JobRunning {
+			delete(t.jobs, id)
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Table) lookup(id string, uid int) (*job, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j, ok := t.jobs[id]
+	if !ok || (uid != 0 && uid != j.owner) {
+		return nil, fmt.Errorf("unknown job %q", id)
+	}
+	return j, nil
+}
+
+// Status returns the current status of job id as seen by uid. Jobs started
+// by another uid are only visible to root.
+func (t *Table) Status(id string, uid int) (ipc.JobStatus, error) {
+	j, err := t.lookup(id, uid)
+	if err != nil {
+		return ipc.JobStatus{}, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return j.status, nil
+}
+
+// Wait blocks until job id finishes or ctx is done and returns its status.
+func (t *Table) Wait(ctx context.Context, id string, uid int) (ipc.JobStatus, error) {
+	j, err := t.lookup(id, uid)
+	if err != nil {
+		return ipc.JobStatus{}, err
+	}
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+	}
+	return t.Status(id, uid)
+}
+
+// Cancel stops job id. Canceling a finished job is a no-op.
+func (t *Table) Cancel(id string, uid int) (ipc.JobStatus, error) {
+	j, err := t.lookup(id, uid)
+	if err != nil {
+		return ipc.JobStatus{}, err
+	}
+	j.cancel()
+	<-j.done
+	return t.Status(id, uid)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,96 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/rbaylon/arkgated/ipc"
+)
+
+// ok finishes at once.
+func ok(ctx context.Context, id string) *ipc.Response {
+	return &ipc.Response{Version: ipc.Version, ID: id, OK: true}
+}
+
+// block runs until its job is canceled.
+func block(ctx context.Context, id string) *ipc.Response {
+	<-ctx.Done()
+	return ipc.NewError(nil, ipc.ErrCanceled, ctx.Err())
+}
+
+func start(t *testing.T, tbl *Table, fn func(context.Context, string) *ipc.Response) string {
+	t.Helper()
+	st, err := tbl.Start(context.Background(), "TEST", 1000, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st.ID
+}
+
+func TestEvictOldestFinished(t *testing.T) {
+	tbl := NewTable(3)
+	running := start(t, tbl, block)
+	defer tbl.Cancel(running, 0)
+	first := start(t, tbl, ok)
+	second := start(t, tbl, ok)
+	for _, id := range []string{first, second} {
+		if _, err := tbl.Wait(context.Background(), id, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	third := start(t, tbl, ok)
+	if _, err := tbl.Status(first, 0); err == nil {
+		t.Error("oldest finished job kept")
+	}
+	for _, id := range []string{running, second, third} {
+		if _, err := tbl.Status(id, 0); err != nil {
+			t.Errorf("job %s: %v", id, err)
+		}
+	}
+}
+
+func TestFull(t *testing.T) {
+	tbl := NewTable(2)
+	for i := 0; i < 2; i++ {
+		id := start(t, tbl, block)
+		defer tbl.Cancel(id, 0)
+	}
+	if _, err := tbl.Start(context.Background(), "TEST", 1000, ok); !errors.Is(err, ErrFull) {
+		t.Errorf("err = %v, want ErrFull", err)
+	}
+}
+
+func TestOwner(t *testing.T) {
+	tbl := NewTable(1)
+	id := start(t, tbl, ok)
+	tests := []struct {
+		uid int
+		ok  bool
+	}{
+		{1000, true},
+		{0, true},
+		{1001, false},
+	}
+	for _, tt := range tests {
+		_, err := tbl.Wait(context.Background(), id, tt.uid)
+		if (err == nil) != tt.ok {
+			t.Errorf("uid %d: err = %v, want visible %v", tt.uid, err, tt.ok)
+		}
+	}
+	if _, err := tbl.Cancel(id, 1001); err == nil || err.Error() != `unknown job "`+id+`"` {
+		t.Errorf("cancel by another uid: err = %v", err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	tbl := NewTable(1)
+	id := start(t, tbl, block)
+	st, err := tbl.Cancel(id, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.State != ipc.JobCanceled || st.Finished == nil {
+		t.Errorf("status %+v, want canceled", st)
+	}
+}
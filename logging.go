@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"sync"
+)
+
+// logLevel is the level of the default logger. It is set from -loglevel
+// and changed on reload without replacing the handler.
+var logLevel = new(slog.LevelVar)
+
+// logSink holds what the default logger currently writes to so that a
+// reload can close it once it has been replaced.
+var logSink struct {
+	mu     sync.Mutex
+	closer io.Closer
+}
+
+// openLog returns a handler writing to output: "stderr", "syslog" or the
+// path of a file that is appended to.
+func openLog(output string, stderr io.Writer) (slog.Handler, io.Closer, error) {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch output {
+	case "stderr":
+		return slog.NewTextHandler(stderr, opts), nil, nil
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "arkgated")
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening syslog: %v", err)
+		}
+		// syslog adds its own timestamp.
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+		return slog.NewTextHandler(&syslogWriter{w}, opts), w, nil
+	default:
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening log file: %v", err)
+		}
+		return slog.NewTextHandler(f, opts), f, nil
+	}
+}
+
+// useLog makes h the default logger, closing whatever the previous one
+// wrote to. The log package goes through h as well.
+func useLog(h slog.Handler, closer io.Closer) {
+	logSink.mu.Lock()
+	defer logSink.mu.Unlock()
+	slog.SetDefault(slog.New(h))
+	if logSink.closer != nil {
+		logSink.closer.Close()
+	}
+	logSink.closer = closer
+}
+
+// setupLogging points the default logger at c.logoutput and sets its level.
+func setupLogging(c *config, stderr io.Writer) error {
+	h, closer, err := openLog(c.logoutput, stderr)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(c.loglevel)
+	useLog(h, closer)
+	return nil
+}
+
+// syslogWriter sends each record to syslog with the priority matching its
+// level. Records arrive one per Write from the text handler and start
+// with their level=.
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func (sw *syslogWriter) Write(p []byte) (int, error) {
+	msg := string(bytes.TrimSuffix(p, []byte("\n")))
+	var err error
+	switch {
+	case bytes.HasPrefix(p, []byte("level=DEBUG")):
+		err = sw.w.Debug(msg)
+	case bytes.HasPrefix(p, []byte("level=WARN")):
+		err = sw.w.Warning(msg)
+	case bytes.HasPrefix(p, []byte("level=ERROR")):
+		err = sw.w.Err(msg)
+	default:
+		err = sw.w.Info(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
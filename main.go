@@ -2,43 +2,68 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/namsral/flag"
-	Arkcommand "github.com/rbaylon/arkgated/arkcommand"
-	pfconfig "github.com/rbaylon/arkgated/config/pf"
+	"github.com/rbaylon/arkgated/metrics"
+	"github.com/rbaylon/arkgated/privsep"
 	"github.com/rbaylon/arkgated/srvclient"
 )
 
 type config struct {
-	maxbuff  int
-	arkgid   int
-	srvcurl  string
-	sockfile string
-	cmdfile  string
-	rundir   string
-	creds    string
+	maxbuff   int
+	maxjobs   int
+	arkgid    int
+	srvcurl   string
+	sockfile  string
+	cmdfile   string
+	rundir    string
+	creds     string
+	auditlog  string
+	auditmax  int64
+	auditkeep int
+	drain     time.Duration
+	user      string
+	pfconf    string
+	loglevel  slog.Level
+	logoutput string
+	metrics   string
+	// args are the command line the config was parsed from, parsed again
+	// on reload.
+	args []string
 }
 
 func (c *config) init(args []string) error {
-	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
 	flags.String(flag.DefaultConfigFlagname, "", "Path to config file")
 
 	var (
-		maxbuff  = flags.Int("maxbuff", 1024, "Max buffer size")
-		srvcurl  = flags.String("srvcurl", "http://127.0.0.1/api/v1/", "Service manager url")
-		sockfile = flags.String("socketfile", "/tmp/arkgated.sock", "Path to create the socket file")
-		arkgid   = flags.Int("arkgid", 1001, "arkgate group id")
-		cmdfile  = flags.String("cmdfile", "./cmd.json", "Path to json command file")
-		rundir   = flags.String("rundir", "./rundir/", "Path to rundir")
-		creds    = flags.String("creds", "./rundir/", "Basic auth api creds")
+		maxbuff     = flags.Int("maxbuff", 1024, "Max size in bytes of a single IPC message, at most 64MiB")
+		maxjobs     = flags.Int("maxjobs", 64, "Max number of async jobs kept in memory")
+		srvcurl     = flags.String("srvcurl", "http://127.0.0.1/api/v1/", "Service manager url")
+		sockfile    = flags.String("socketfile", "/tmp/arkgated.sock", "Path to create the socket file")
+		arkgid      = flags.Int("arkgid", 1001, "arkgate group id")
+		cmdfile     = flags.String("cmdfile", "./cmd.json", "Path to json command file")
+		rundir      = flags.String("rundir", "./rundir/", "Path to rundir")
+		creds       = flags.String("creds", "./rundir/", "Basic auth api creds")
+		auditlog    = flags.String("auditlog", "audit.log", "Audit log file name, relative to rundir")
+		auditmax    = flags.Int64("auditmaxsize", 10*1024*1024, "Size in bytes at which the audit log is rotated")
+		auditkeep   = flags.Int("auditkeep", 5, "Number of rotated audit logs to keep")
+		user        = flags.String("user", "", "Run everything but pf operations as this user, needs root")
+		pfconf      = flags.String("pfconf", "/etc/pf.conf", "Ruleset loaded after installing a generated pf config")
+		drain       = flags.Duration("shutdowntimeout", 30*time.Second, "How long to wait for running commands on shutdown before canceling them")
+		loglevel    = flags.String("loglevel", "info", "Log level: debug, info, warn or error")
+		logoutput   = flags.String("logoutput", "stderr", "Where to log: stderr, syslog or a file path")
+		metricsaddr = flags.String("metricsaddr", "", "Serve Prometheus metrics on this host:port or unix socket path, off when empty")
 	)
 
 	if err := flags.Parse(args[1:]); err != nil {
@@ -46,91 +71,143 @@ func (c *config) init(args []string) error {
 	}
 
 	c.maxbuff = *maxbuff
+	c.maxjobs = *maxjobs
 	c.srvcurl = *srvcurl
 	c.sockfile = *sockfile
 	c.arkgid = *arkgid
 	c.cmdfile = *cmdfile
 	c.rundir = *rundir
 	c.creds = *creds
+	c.auditlog = *auditlog
+	c.auditmax = *auditmax
+	c.auditkeep = *auditkeep
+	c.drain = *drain
+	c.user = *user
+	c.pfconf = *pfconf
+	if err := c.loglevel.UnmarshalText([]byte(*loglevel)); err != nil {
+		return fmt.Errorf("-loglevel: %v", err)
+	}
+	c.logoutput = *logoutput
+	c.metrics = *metricsaddr
+	c.args = args
 	return nil
 }
 
-func run(c *config, out io.Writer, sock net.Listener) error {
-	log.SetOutput(out)
-	pfcfg, err := pfconfig.Init(c.rundir + "config.json")
+// run serves requests on sock until ctx is canceled. Logs go to out when
+// logging to stderr. priv is the
+// privileged helper when running privilege separated, nil otherwise.
+// fixedSocket is set when sock belongs to a parent process or service
+// manager and must not be replaced on reload.
+func run(ctx context.Context, c *config, out io.Writer, sock net.Listener, fixedSocket bool, hup <-chan struct{}, priv *privsep.Client) error {
+	if err := setupLogging(c, out); err != nil {
+		return err
+	}
+	st, err := loadState(c, nil, priv)
 	if err != nil {
-		log.Println("Error reading json config: ", err)
+		return err
 	}
 
-	srvclient.Enroll(c.srvcurl, apitoken, pfcfg)
+	if c.metrics != "" {
+		ms, err := serveMetrics(c.metrics, c.arkgid)
+		if err != nil {
+			return fmt.Errorf("metrics: %v", err)
+		}
+		defer ms.Close()
+	}
 
-	err = pfcfg.Create(c.rundir, c.srvcurl, apitoken)
+	// Commands run under their own context so that a shutdown can let them
+	// finish before canceling them.
+	workctx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+	srv := newServer(workctx, st, priv, fixedSocket)
+	srv.health.enroll(srvclient.Enroll(c.srvcurl, st.token, st.pfcfg))
+	defer func() {
+		srv.state().audit.Close()
+	}()
+	_, err = srv.regenerate(ctx)
 	if err != nil {
-		log.Println("Error creating pf config file: ", err)
+		slog.Error("Error creating pf config file", "router", st.pfcfg.Router, "err", err)
 	}
 
+	srv.serveListener(sock)
 	for {
-		log.Println("Blocking until we get connection")
-		conn, err := sock.Accept()
-		if err != nil {
+		select {
+		case err := <-srv.errc:
 			return err
+		case <-hup:
+			// A reload can wait on the api and the config lock, signals
+			// are still handled meanwhile.
+			srv.busy.Add(1)
+			go func() {
+				defer srv.busy.Done()
+				srv.reload(srv.state().c.args, out)
+			}()
+		case <-ctx.Done():
+			slog.Info("Shutting down")
+			srv.shutdown(srv.state().c.drain, cancelWork)
+			return nil
 		}
-		go func(conn net.Conn) {
-			log.Println("connection accepted")
-			defer conn.Close()
-			buf := make([]byte, c.maxbuff)
-			n, err := conn.Read(buf)
-			if err != nil {
-				log.Println(err)
-			}
-			msg := buf[:n]
-			var cmd Arkcommand.Arkcmd
-			err = json.Unmarshal(msg, &cmd)
-			log.Printf("%v", cmd)
-			if err != nil {
-				_, err = conn.Write([]byte("NOK"))
-				if err != nil {
-					log.Println("Reply error: ", err)
-				}
-			}
-			if cmd.Name == "CheckPF" {
-				pfcfg.Create(c.rundir, c.srvcurl, apitoken)
-			}
-			_, err = cmd.Run()
-			if err != nil {
-				log.Println(err)
-				_, err = conn.Write([]byte("NOK"))
-				if err != nil {
-					log.Println(err)
-				}
-			}
-			conn.Write([]byte("OK"))
-		}(conn)
 	}
 }
 
-func waitForSignal(cancel context.CancelFunc, ctx context.Context, c *config, sigchan chan os.Signal) {
-	for {
-		select {
-		case s := <-sigchan:
-			switch s {
-			case syscall.SIGINT, syscall.SIGTERM:
-				log.Printf("Got SIGINT/SIGTERM, exiting.")
-				os.Remove(c.sockfile)
+// serveMetrics serves /metrics over http on addr, a host:port or the path
+// of a unix socket accessible to group gid when it contains a slash.
+func serveMetrics(addr string, gid int) (io.Closer, error) {
+	var ln net.Listener
+	var err error
+	if strings.Contains(addr, "/") {
+		ln, err = listenUnix(addr, gid)
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	hs := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := hs.Serve(ln); err != http.ErrServerClosed {
+			slog.Error("Metrics server stopped", "err", err)
+		}
+	}()
+	slog.Info("Serving metrics", "addr", addr)
+	return hs, nil
+}
+
+// waitForSignal cancels ctx on the first SIGINT/SIGTERM so that run shuts
+// down gracefully, a second one exits right away. SIGHUP is passed on to
+// run through hup.
+func waitForSignal(cancel context.CancelFunc, sigchan chan os.Signal, hup chan<- struct{}) {
+	stopping := false
+	for s := range sigchan {
+		switch s {
+		case syscall.SIGINT, syscall.SIGTERM:
+			if stopping {
+				slog.Warn("Got SIGINT/SIGTERM again, exiting now")
 				os.Exit(2)
-			case syscall.SIGHUP:
-				log.Println("SIGHUP received. Relaoding config.")
-				c.init(os.Args)
 			}
-		case <-ctx.Done():
-			log.Printf("Context Done.")
+			slog.Info("Got SIGINT/SIGTERM, shutting down")
+			stopping = true
+			cancel()
+		case syscall.SIGHUP:
+			slog.Info("SIGHUP received, reloading config")
+			select {
+			case hup <- struct{}{}:
+			default:
+			}
 		}
 	}
 }
 
-var apitoken *string
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "supervise" {
+		os.Exit(supervise(os.Args[2:]))
+	}
+
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 
@@ -138,32 +215,44 @@ func main() {
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGKILL)
 
 	c := &config{}
-
-	go waitForSignal(cancel, ctx, c, signalChan)
-
-	c.init(os.Args)
-	socket, err := net.Listen("unix", c.sockfile)
-	if err != nil {
-		log.Fatal(err)
+	if err := c.init(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
 	}
-	err = os.Chown(c.sockfile, os.Getuid(), c.arkgid)
-	if err != nil {
-		log.Fatal(err)
+	if err := setupLogging(c, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	var socket net.Listener
+	var priv *privsep.Client
+	var fixed bool
+	var err error
+	switch {
+	case os.Getenv(privsepEnv) != "":
+		socket, priv, err = privsepChild()
+		fixed = true
+	case c.user != "":
+		if os.Getuid() != 0 {
+			slog.Error("-user needs arkgated to be started as root")
+			os.Exit(1)
+		}
+		signal.Stop(signalChan)
+		os.Exit(runPrivileged(c))
+	default:
+		socket, fixed, err = openListener(c)
 	}
-	err = os.Chmod(c.sockfile, 0660)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("Unable to listen", "socket", c.sockfile, "err", err)
+		os.Exit(1)
 	}
 
-	log.Println("IPC running ")
+	hup := make(chan struct{}, 1)
+	go waitForSignal(cancel, signalChan, hup)
 
-	token, err := srvclient.GetToken(c.creds, c.srvcurl+"login")
-	apitoken = token
-	if err != nil {
-		log.Println(err)
-	}
+	slog.Info("IPC running", "socket", c.sockfile, "version", version)
 
-	if err := run(c, os.Stdout, socket); err != nil {
+	if err := run(ctx, c, os.Stderr, socket, fixed, hup, priv); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rbaylon/arkgated/client"
+	"github.com/rbaylon/arkgated/ipc"
+)
+
+func TestRun(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			w.Write([]byte(`{"Name": "arkgated", "Jwt": "token"}`))
+		case "/pfconfig/query/devopenbsd":
+			w.Write([]byte(`{}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+	c := testConfig(t, `{"name": "ECHO", "cmd": "/bin/echo", "opts": ["hello"], `+allowAll()+`}`)
+	c.srvcurl = api.URL + "/"
+	prev := slog.Default()
+	defer slog.SetDefault(prev)
+	ln, err := net.Listen("unix", c.sockfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- run(ctx, c, io.Discard, ln, false, nil, nil)
+	}()
+	cl, err := client.Dial(c.sockfile, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	rctx, rcancel := context.WithTimeout(ctx, 10*time.Second)
+	defer rcancel()
+	resp, err := cl.Run(rctx, "ECHO", nil)
+	if err != nil || resp.Stdout != "hello\n" {
+		t.Errorf("ECHO: got %+v, %v", resp, err)
+	}
+	resp, err = cl.Run(rctx, "NOPE", nil)
+	var ierr *ipc.Error
+	if !errors.As(err, &ierr) || ierr.Code != ipc.ErrUnknownCommand {
+		t.Errorf("NOPE: err = %v, want %s", err, ipc.ErrUnknownCommand)
+	}
+	if resp == nil || resp.OK || resp.Version != ipc.Version || resp.ExitCode != -1 {
+		t.Errorf("NOPE: envelope %+v", resp)
+	}
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("run: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run did not return after cancel")
+	}
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The metrics of arkgated. Results are "ok" or an ipc error code.
+var (
+	Requests        = NewCounter("arkgated_ipc_requests_total", "IPC requests by command and result.", "command", "result")
+	CommandDuration = NewHistogram("arkgated_command_duration_seconds", "Time allowlisted commands took to run.", "command")
+	RegenDuration   = NewHistogram("arkgated_regen_duration_seconds", "Time spent generating the pf config.")
+	RegenFailures   = NewCounter("arkgated_regen_failures_total", "Failed pf config generations.")
+	APIDuration     = NewHistogram("arkgated_api_request_duration_seconds", "Latency of service manager api calls.", "endpoint")
+	APIRequests     = NewCounter("arkgated_api_requests_total", "Service manager api calls by endpoint and status code.", "endpoint", "code")
+	Vouchers        = NewGauge("arkgated_vouchers_active", "Active vouchers in the last subscriber list fetched.")
+	Subs            = NewGauge("arkgated_subs_active", "Active subscribers in the last subscriber list fetched.")
+	LastSync        = NewGauge("arkgated_last_sync_timestamp_seconds", "Unix time of the last successful pf config generation.")
+)
+
+var lastSync atomic.Int64
+
+func init() {
+	NewGaugeFunc("arkgated_seconds_since_last_sync", "Seconds since the last successful pf config generation, NaN before the first.", func() float64 {
+		t := lastSync.Load()
+		if t == 0 {
+			return math.NaN()
+		}
+		return time.Since(time.Unix(0, t)).Seconds()
+	})
+}
+
+// Synced records a successful pf config generation.
+func Synced() {
+	now := time.Now()
+	lastSync.Store(now.UnixNano())
+	LastSync.Set(float64(now.UnixNano()) / 1e9)
+}
+
+// ObserveAPI records an api call to endpoint started at start. The code
+// is "error" when no response was received.
+func ObserveAPI(endpoint string, start time.Time, res *http.Response, err error) {
+	APIDuration.Since(start, endpoint)
+	code := "error"
+	if err == nil && res != nil {
+		code = strconv.Itoa(res.StatusCode)
+	}
+	APIRequests.Inc(endpoint, code)
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "Test durations.", "cmd")
+	c := NewCounter("test_requests_total", "Test\\requests\nserved.", "cmd")
+	label := "a\"b\\c\nd"
+	for _, v := range []float64{0.5, 2, 1000} {
+		h.Observe(v, label)
+	}
+	c.Inc(label)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	lines := map[string]bool{}
+	for _, l := range strings.Split(rec.Body.String(), "\n") {
+		lines[l] = true
+	}
+	want := []string{
+		`# HELP test_duration_seconds Test durations.`,
+		`# TYPE test_duration_seconds histogram`,
+		`test_duration_seconds_bucket{cmd="a\"b\\c\nd",le="0.25"} 0`,
+		`test_duration_seconds_bucket{cmd="a\"b\\c\nd",le="0.5"} 1`,
+		`test_duration_seconds_bucket{cmd="a\"b\\c\nd",le="1"} 1`,
+		`test_duration_seconds_bucket{cmd="a\"b\\c\nd",le="2.5"} 2`,
+		`test_duration_seconds_bucket{cmd="a\"b\\c\nd",le="300"} 2`,
+		`test_duration_seconds_bucket{cmd="a\"b\\c\nd",le="+Inf"} 3`,
+		`test_duration_seconds_sum{cmd="a\"b\\c\nd"} 1002.5`,
+		`test_duration_seconds_count{cmd="a\"b\\c\nd"} 3`,
+		`# HELP test_requests_total Test\\requests\nserved.`,
+		`# TYPE test_requests_total counter`,
+		`test_requests_total{cmd="a\"b\\c\nd"} 1`,
+	}
+	for _, l := range want {
+		if !lines[l] {
+			t.Errorf("missing line %s", l)
+		}
+	}
+	if t.Failed() {
+		t.Logf("output:\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,167 @@
+package privsep
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	Arkcommand "github.com/rbaylon/arkgated/arkcommand"
+	pfconfig "github.com/rbaylon/arkgated/config/pf"
+	"github.com/rbaylon/arkgated/ipc"
+)
+
+// Client is the unprivileged end. It is safe for concurrent use.
+type Client struct {
+	conn net.Conn
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]chan *Response
+	err     error
+}
+
+// NewClient starts reading responses from conn.
+func NewClient(conn net.Conn) *Client {
+	c := &Client{conn: conn, pending: map[uint64]chan *Response{}}
+	go c.read()
+	return c
+}
+
+func (c *Client) read() {
+	r := bufio.NewReader(c.conn)
+	for {
+		var resp Response
+		if err := ipc.ReadMsg(r, maxMsg, &resp); err != nil {
+			c.mu.Lock()
+			c.err = fmt.Errorf("privsep helper gone: %v", err)
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+			slog.Error("privsep: connection to helper lost", "err", c.err)
+			return
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[resp.ID]
+		delete(c.pending, resp.ID)
+		c.mu.Unlock()
+		if ok {
+			ch <- &resp
+		}
+	}
+}
+
+func (c *Client) send(req *Request) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return ipc.WriteMsg(c.conn, req)
+}
+
+// call sends req and waits for its response. When ctx is done the helper
+// is asked to cancel the request, whose response is still waited for.
+func (c *Client) call(ctx context.Context, req *Request) (*Response, error) {
+	ch := make(chan *Response, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.seq++
+	req.ID = c.seq
+	c.pending[req.ID] = ch
+	c.mu.Unlock()
+	if err := c.send(req); err != nil {
+		c.mu.Lock()
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+		return nil, err
+	}
+	var resp *Response
+	select {
+	case resp = <-ch:
+	case <-ctx.Done():
+		c.send(&Request{Op: OpCancel, Cancel: req.ID})
+		resp = <-ch
+	}
+	if resp == nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return nil, c.err
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// Install asks the helper to install and load a generation of generated
+// files, it makes Client a pfconfig.Installer.
+func (c *Client) Install(ctx context.Context, files []pfconfig.File) (*pfconfig.InstallResult, error) {
+	resp, err := c.call(ctx, &Request{Op: OpInstall, Files: files})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Install == nil {
+		return &pfconfig.InstallResult{}, nil
+	}
+	return resp.Install, nil
+}
+
+// Exec runs the privileged command name with args in the helper.
+func (c *Client) Exec(ctx context.Context, name string, args map[string]string) (*Arkcommand.Result, error) {
+	resp, err := c.call(ctx, &Request{Op: OpExec, Name: name, Args: args})
+	res := &Arkcommand.Result{ExitCode: -1}
+	if resp != nil && resp.Result != nil {
+		res = resp.Result
+	}
+	return res, err
+}
+
+// Wrap returns cmd with Run and Stream going through the helper, which
+// only runs privileged commands. Params, ACL and concurrency are still
+// checked locally.
+func (c *Client) Wrap(cmd Arkcommand.Cmd) Arkcommand.Cmd {
+	return &remoteCmd{Cmd: cmd, c: c}
+}
+
+type remoteCmd struct {
+	Arkcommand.Cmd
+	c    *Client
+	args map[string]string
+}
+
+func (rc *remoteCmd) Bind(args map[string]string) (Arkcommand.Cmd, error) {
+	bound, err := rc.Cmd.Bind(args)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteCmd{Cmd: bound, c: rc.c, args: args}, nil
+}
+
+func (rc *remoteCmd) Run(ctx context.Context) (*Arkcommand.Result, error) {
+	name, _ := rc.Describe()
+	return rc.c.Exec(ctx, name, rc.args)
+}
+
+// Stream runs the command in the helper. The helper does not stream, the
+// lines are handed to onLine once the command is done.
+func (rc *remoteCmd) Stream(ctx context.Context, onLine Arkcommand.LineFunc) (*Arkcommand.Result, error) {
+	res, err := rc.Run(ctx)
+	if onLine != nil {
+		for _, out := range []struct{ stream, text string }{{"stdout", res.Stdout}, {"stderr", res.Stderr}} {
+			for _, line := range strings.Split(strings.TrimSuffix(out.text, "\n"), "\n") {
+				if line != "" {
+					onLine(out.stream, line)
+				}
+			}
+		}
+	}
+	return res, err
+}
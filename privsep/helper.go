@@ -0,0 +1,178 @@
+package privsep
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	Arkcommand "github.com/rbaylon/arkgated/arkcommand"
+	pfconfig "github.com/rbaylon/arkgated/config/pf"
+	"github.com/rbaylon/arkgated/ipc"
+)
+
+// Helper runs in the privileged process and serves the requests of the
+// unprivileged one. It never trusts a path or command line sent to it:
+// files are looked up by name in the set generated from config.json and
+// commands in its own copy of the command file, where they must be marked
+// privileged.
+type Helper struct {
+	mu       sync.Mutex
+	rundir   string
+	pfconf   string
+	cmds     map[string]Arkcommand.Cmd
+	files    map[string]bool
+	inflight map[uint64]context.CancelFunc
+}
+
+// NewHelper returns a helper with nothing loaded.
+func NewHelper() *Helper {
+	return &Helper{inflight: map[uint64]context.CancelFunc{}}
+}
+
+// Load (re)reads the command file and the config.json in rundir. OpInstall
+// then installs into rundir and loads pfconf. On error the helper keeps
+// what it had.
+func (h *Helper) Load(cmdfile, rundir, pfconf string) error {
+	cmds, err := Arkcommand.Init(cmdfile)
+	if err != nil {
+		return err
+	}
+	cfg, err := pfconfig.Init(rundir + "config.json")
+	if err != nil {
+		return err
+	}
+	files := map[string]bool{"pf.conf": true, "dhcpd.conf": true}
+	for _, name := range []string{cfg.WifiIpList, cfg.SubsIpList} {
+		if name != "" && filepath.Base(name) == name {
+			files[name] = true
+		}
+	}
+	h.mu.Lock()
+	h.cmds = cmds
+	h.files = files
+	h.rundir = rundir
+	h.pfconf = pfconf
+	h.mu.Unlock()
+	return nil
+}
+
+// Serve handles requests on conn until it is closed. Requests run
+// concurrently, responses may come back out of order.
+func (h *Helper) Serve(ctx context.Context, conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	var wmu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		var req Request
+		if err := ipc.ReadMsg(r, maxMsg, &req); err != nil {
+			return err
+		}
+		if req.Op == OpCancel {
+			h.mu.Lock()
+			if cancel, ok := h.inflight[req.Cancel]; ok {
+				cancel()
+			}
+			h.mu.Unlock()
+			continue
+		}
+		rctx, cancel := context.WithCancel(ctx)
+		h.mu.Lock()
+		h.inflight[req.ID] = cancel
+		h.mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := h.do(rctx, &req)
+			h.mu.Lock()
+			delete(h.inflight, req.ID)
+			h.mu.Unlock()
+			cancel()
+			resp.ID = req.ID
+			wmu.Lock()
+			err := ipc.WriteMsg(conn, resp)
+			wmu.Unlock()
+			if err != nil {
+				slog.Warn("privsep: reply error", "err", err)
+			}
+		}()
+	}
+}
+
+func (h *Helper) do(ctx context.Context, req *Request) *Response {
+	switch req.Op {
+	case OpInstall:
+		h.mu.Lock()
+		files, rundir, pfconf := h.files, h.rundir, h.pfconf
+		h.mu.Unlock()
+		for _, f := range req.Files {
+			if !files[f.Name] {
+				return h.deny(req, fmt.Errorf("file %q may not be written", f.Name))
+			}
+		}
+		inst := &pfconfig.DirInstaller{Dir: rundir, PfConf: pfconf}
+		res, err := inst.Install(ctx, req.Files)
+		if err != nil {
+			return &Response{Error: err.Error()}
+		}
+		return &Response{Install: res}
+	case OpExec:
+		h.mu.Lock()
+		cmds := h.cmds
+		h.mu.Unlock()
+		cmd, err := Arkcommand.Lookup(cmds, req.Name)
+		if err != nil {
+			return h.deny(req, err)
+		}
+		if !cmd.NeedsRoot() {
+			return h.deny(req, fmt.Errorf("command %q is not privileged", req.Name))
+		}
+		cmd, err = cmd.Bind(req.Args)
+		if err != nil {
+			return h.deny(req, err)
+		}
+		return result(cmd.Run(ctx))
+	}
+	return h.deny(req, fmt.Errorf("unknown op %q", req.Op))
+}
+
+// deny logs and refuses a request the unprivileged process should never
+// have sent.
+func (h *Helper) deny(req *Request, err error) *Response {
+	slog.Warn("privsep: refused", "op", req.Op, "err", err)
+	return &Response{Error: err.Error()}
+}
+
+func result(res *Arkcommand.Result, err error) *Response {
+	resp := &Response{Result: res}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// Socketpair returns the two connected ends used between the processes,
+// the second one as a file to hand to the child.
+func Socketpair() (net.Conn, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	parent := os.NewFile(uintptr(fds[0]), "privsep")
+	child := os.NewFile(uintptr(fds[1]), "privsep-child")
+	conn, err := net.FileConn(parent)
+	parent.Close()
+	if err != nil {
+		child.Close()
+		return nil, nil, err
+	}
+	return conn, child, nil
+}
@@ -0,0 +1,77 @@
+package privsep
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHelperExecPrivilegedOnly(t *testing.T) {
+	dir := t.TempDir()
+	cmdfile := filepath.Join(dir, "cmd.json")
+	err := os.WriteFile(cmdfile, []byte(`{"cmds": [
+		{"name": "ROOT", "cmd": "/bin/echo", "opts": ["root"], "privileged": true},
+		{"name": "USER", "cmd": "/bin/echo", "opts": ["user"]}
+	]}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHelper()
+	if err := h.Load(cmdfile, "../rundir/", filepath.Join(dir, "pf.conf")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		out     string
+		wantErr string
+	}{
+		{name: "ROOT", out: "root\n"},
+		{name: "USER", wantErr: "not privileged"},
+		{name: "MISSING", wantErr: "unknown command"},
+	}
+	for _, tt := range tests {
+		resp := h.do(context.Background(), &Request{Op: OpExec, Name: tt.name})
+		if tt.wantErr != "" {
+			if !strings.Contains(resp.Error, tt.wantErr) {
+				t.Errorf("%s: error %q, want %q", tt.name, resp.Error, tt.wantErr)
+			}
+			continue
+		}
+		if resp.Error != "" || resp.Result == nil || resp.Result.Stdout != tt.out {
+			t.Errorf("%s: got %+v, error %q", tt.name, resp.Result, resp.Error)
+		}
+	}
+}
+
+func TestHelperLoadSwitchesRundir(t *testing.T) {
+	dir := t.TempDir() + "/"
+	cmdfile := filepath.Join(dir, "cmd.json")
+	if err := os.WriteFile(cmdfile, []byte(`{"cmds": []}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := os.ReadFile("../rundir/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir+"config.json", cfg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHelper()
+	if err := h.Load(cmdfile, "../rundir/", "/etc/pf.conf"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Load(cmdfile, dir, dir+"pf.conf"); err != nil {
+		t.Fatal(err)
+	}
+	if h.rundir != dir || h.pfconf != dir+"pf.conf" {
+		t.Errorf("rundir %q, pfconf %q after reload", h.rundir, h.pfconf)
+	}
+	if err := h.Load(cmdfile, dir+"missing/", "/etc/pf.conf"); err == nil {
+		t.Fatal("loaded a rundir without config.json")
+	}
+	if h.rundir != dir || h.pfconf != dir+"pf.conf" {
+		t.Errorf("failed load changed rundir to %q, pfconf to %q", h.rundir, h.pfconf)
+	}
+}
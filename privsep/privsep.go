@@ -0,0 +1,46 @@
+// Package privsep splits arkgated into an unprivileged process, which
+// talks to clients and the service manager, and a small privileged helper
+// that performs the few operations needing root. The two talk over a
+// socketpair using the ipc framing and the messages below.
+package privsep
+
+import (
+	Arkcommand "github.com/rbaylon/arkgated/arkcommand"
+	pfconfig "github.com/rbaylon/arkgated/config/pf"
+)
+
+// Operations understood by the helper.
+const (
+	// OpInstall installs Files in rundir and loads the ruleset, see
+	// pfconfig.DirInstaller. Every name must be one of the files generated
+	// from config.json.
+	OpInstall = "install"
+	// OpExec runs a privileged command from the helper's own copy of the
+	// command file. Args are validated again by the helper, the ACL is
+	// checked by the unprivileged process only, so any privileged command
+	// may be run as root.
+	OpExec = "exec"
+	// OpCancel cancels request ID.
+	OpCancel = "cancel"
+)
+
+// maxMsg bounds messages between the processes, rendered files included.
+const maxMsg = 64 * 1024 * 1024
+
+type Request struct {
+	ID    uint64            `json:"id"`
+	Op    string            `json:"op"`
+	Name  string            `json:"name,omitempty"`
+	Files []pfconfig.File   `json:"files,omitempty"`
+	Args  map[string]string `json:"args,omitempty"`
+	// Cancel is the request to cancel for OpCancel.
+	Cancel uint64 `json:"cancel,omitempty"`
+}
+
+type Response struct {
+	ID     uint64             `json:"id"`
+	Error  string             `json:"error,omitempty"`
+	Result *Arkcommand.Result `json:"result,omitempty"`
+	// Install is what OpInstall changed.
+	Install *pfconfig.InstallResult `json:"install,omitempty"`
+}
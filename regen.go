@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	pfconfig "github.com/rbaylon/arkgated/config/pf"
+)
+
+// regenRun is one config generation shared by every caller that asked for
+// it before it started.
+type regenRun struct {
+	done chan struct{}
+	sum  *pfconfig.Summary
+	err  error
+}
+
+// regenGroup runs config generations one at a time. Requests that arrive
+// while a generation is already waiting to start are coalesced into it, so
+// a burst of CheckPF requests causes at most two runs.
+type regenGroup struct {
+	mu      sync.Mutex
+	next    *regenRun
+	running sync.Mutex
+	wg      sync.WaitGroup
+}
+
+// Do waits for the next generation to finish and returns its outcome.
+// ctx only bounds the wait, a run that has been queued always completes.
+func (g *regenGroup) Do(ctx context.Context, fn func() (*pfconfig.Summary, error)) (*pfconfig.Summary, error) {
+	g.mu.Lock()
+	run := g.next
+	if run == nil {
+		run = &regenRun{done: make(chan struct{})}
+		g.next = run
+		g.wg.Add(1)
+		go g.start(run, fn)
+	}
+	g.mu.Unlock()
+	select {
+	case <-run.done:
+		return run.sum, run.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Wait blocks until every queued generation has finished.
+func (g *regenGroup) Wait() {
+	g.wg.Wait()
+}
+
+func (g *regenGroup) start(run *regenRun, fn func() (*pfconfig.Summary, error)) {
+	defer g.wg.Done()
+	g.running.Lock()
+	defer g.running.Unlock()
+	g.mu.Lock()
+	g.next = nil
+	g.mu.Unlock()
+	run.sum, run.err = fn()
+	close(run.done)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pfconfig "github.com/rbaylon/arkgated/config/pf"
+)
+
+// blockingRun starts a generation on g that runs until release is closed
+// and returns once it has started.
+func blockingRun(g *regenGroup, runs *atomic.Int32, release chan struct{}) {
+	started := make(chan struct{})
+	go g.Do(context.Background(), func() (*pfconfig.Summary, error) {
+		runs.Add(1)
+		close(started)
+		<-release
+		return &pfconfig.Summary{}, nil
+	})
+	<-started
+}
+
+func TestRegenGroupCoalesces(t *testing.T) {
+	var g regenGroup
+	var runs atomic.Int32
+	release := make(chan struct{})
+	blockingRun(&g, &runs, release)
+
+	const n = 10
+	var entered, done sync.WaitGroup
+	entered.Add(n)
+	done.Add(n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer done.Done()
+			entered.Done()
+			_, err := g.Do(context.Background(), func() (*pfconfig.Summary, error) {
+				runs.Add(1)
+				return &pfconfig.Summary{}, nil
+			})
+			errs <- err
+		}()
+	}
+	entered.Wait()
+	// Give the callers time to queue behind the running generation.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	done.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Do: %v", err)
+		}
+	}
+	g.Wait()
+	if got := runs.Load(); got != 2 {
+		t.Errorf("runs = %d, want 2", got)
+	}
+}
+
+func TestRegenGroupCanceledWait(t *testing.T) {
+	var g regenGroup
+	var runs atomic.Int32
+	release := make(chan struct{})
+	blockingRun(&g, &runs, release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := g.Do(ctx, func() (*pfconfig.Summary, error) {
+			runs.Add(1)
+			return &pfconfig.Summary{}, nil
+		})
+		errc <- err
+	}()
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want Canceled", err)
+	}
+	close(release)
+	g.Wait()
+	if got := runs.Load(); got != 2 {
+		t.Errorf("runs = %d, want 2, the queued run still completes", got)
+	}
+}
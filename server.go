@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	Arkcommand "github.com/rbaylon/arkgated/arkcommand"
+	"github.com/rbaylon/arkgated/audit"
+	pfconfig "github.com/rbaylon/arkgated/config/pf"
+	"github.com/rbaylon/arkgated/ipc"
+	"github.com/rbaylon/arkgated/jobs"
+	"github.com/rbaylon/arkgated/metrics"
+	"github.com/rbaylon/arkgated/privsep"
+	"github.com/rbaylon/arkgated/srvclient"
+	"golang.org/x/sync/semaphore"
+)
+
+type server struct {
+	// ctx outlives client connections, async jobs run under it. It is
+	// only canceled when draining on shutdown takes too long.
+	ctx  context.Context
+	st   atomic.Pointer[state]
+	jobs *jobs.Table
+	// cfglock is held exclusively while the pf config is generated and
+	// shared or exclusively by commands, see Arkcmd.Concurrency.
+	cfglock *semaphore.Weighted
+	regen   regenGroup
+	started time.Time
+	health  health
+	// queued counts commands waiting for cfglock or a slot, running those
+	// executing.
+	queued  atomic.Int64
+	running atomic.Int64
+
+	mu       sync.Mutex
+	ln       net.Listener
+	conns    map[net.Conn]struct{}
+	draining atomic.Bool
+	// busy counts connection handlers, async jobs and reloads.
+	busy sync.WaitGroup
+	// reloading serializes reloads.
+	reloading sync.Mutex
+	// errc receives the error that stopped the current listener.
+	errc chan error
+	// priv performs root operations when running privilege separated.
+	priv *privsep.Client
+	// fixed is set when the listener was handed to us and can not be
+	// moved to another path.
+	fixed bool
+}
+
+// newServer returns a server running commands under ctx with st as its
+// state. priv and fixed are as for run.
+func newServer(ctx context.Context, st *state, priv *privsep.Client, fixed bool) *server {
+	s := &server{
+		ctx:     ctx,
+		conns:   map[net.Conn]struct{}{},
+		jobs:    jobs.NewTable(st.c.maxjobs),
+		cfglock: semaphore.NewWeighted(Arkcommand.LockWeight),
+		started: time.Now(),
+		errc:    make(chan error, 1),
+		priv:    priv,
+		fixed:   fixed,
+	}
+	s.st.Store(st)
+	return s
+}
+
+// errReloaded is returned by create when a reload switched the state
+// while the subscribers were fetched.
+var errReloaded = errors.New("reloaded while fetching subscribers")
+
+// create generates and installs the pf config for st and subs under the
+// exclusive config lock. It fails with errReloaded when the current state
+// is no longer cur by then. commit, if not nil, runs under the lock once
+// the config is installed.
+func (s *server) create(cur, st *state, subs *pfconfig.PfConfig, commit func()) (*pfconfig.Summary, error) {
+	if err := s.cfglock.Acquire(s.ctx, Arkcommand.LockWeight); err != nil {
+		return nil, err
+	}
+	defer s.cfglock.Release(Arkcommand.LockWeight)
+	if s.state() != cur {
+		return nil, errReloaded
+	}
+	sum, err := st.pfcfg.Create(s.ctx, st.c.rundir, subs, s.installer(st))
+	if err == nil && commit != nil {
+		commit()
+	}
+	return sum, err
+}
+
+// installer installs and loads generated files, through the privileged
+// helper if there is one.
+func (s *server) installer(st *state) pfconfig.Installer {
+	if s.priv != nil {
+		return s.priv
+	}
+	return &pfconfig.DirInstaller{Dir: st.c.rundir, PfConf: st.c.pfconf}
+}
+
+func (s *server) state() *state {
+	return s.st.Load()
+}
+
+// serveListener accepts connections on ln from now on. A listener served
+// before is closed.
+func (s *server) serveListener(ln net.Listener) {
+	s.mu.Lock()
+	old := s.ln
+	s.ln = ln
+	s.mu.Unlock()
+	go s.serve(ln)
+	if old != nil {
+		old.Close()
+	}
+}
+
+func (s *server) serve(ln net.Listener) {
+	for {
+		slog.Debug("Blocking until we get connection")
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			current := s.ln == ln
+			s.mu.Unlock()
+			if current {
+				s.errc <- err
+			}
+			return
+		}
+		s.mu.Lock()
+		if s.draining.Load() {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.busy.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.busy.Done()
+			s.handle(s.ctx, conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// shutdown stops accepting connections and waits for running requests,
+// async jobs and config generations to finish. Commands still running at
+// the deadline are canceled through cancel, which must cancel s.ctx.
+func (s *server) shutdown(deadline time.Duration, cancel context.CancelFunc) {
+	s.mu.Lock()
+	s.draining.Store(true)
+	ln := s.ln
+	s.ln = nil
+	// Wake up readers blocked waiting for the next request. handle lets
+	// the request in progress finish.
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+	if ln != nil {
+		ln.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		s.busy.Wait()
+		s.regen.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("All requests finished")
+		return
+	case <-time.After(deadline):
+	}
+	slog.Warn("Requests still running, canceling them", "after", deadline)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(4 * time.Second):
+		slog.Error("Gave up waiting for requests")
+	}
+}
+
+// regenerate rebuilds the pf config. Concurrent callers share one run.
+func (s *server) regenerate(ctx context.Context) (*pfconfig.Summary, error) {
+	return s.regen.Do(ctx, func() (*pfconfig.Summary, error) {
+		for {
+			st := s.state()
+			sum, err := s.generate(st, st, nil)
+			if err != errReloaded {
+				return sum, err
+			}
+		}
+	})
+}
+
+// generate builds the pf config for st and records the outcome, see
+// create for cur and commit. The subscribers are fetched before taking the
+// config lock, so that a slow api does not hold up the commands waiting
+// on it.
+func (s *server) generate(cur, st *state, commit func()) (*pfconfig.Summary, error) {
+	start := time.Now()
+	var sum *pfconfig.Summary
+	subs, err := srvclient.GetSubs(s.ctx, st.c.srvcurl+"pfconfig/query/"+st.pfcfg.Router, st.token)
+	if err == nil {
+		sum, err = s.create(cur, st, subs, commit)
+	}
+	if err == errReloaded {
+		return nil, err
+	}
+	metrics.RegenDuration.Since(start)
+	s.health.sync(sum, err)
+	if err != nil {
+		metrics.RegenFailures.Inc()
+		return nil, err
+	}
+	metrics.Synced()
+	metrics.Vouchers.Set(float64(sum.Vouchers))
+	metrics.Subs.Set(float64(sum.Subs))
+	return sum, nil
+}
+
+// frame is one message read off a connection, or the error reading it.
+type frame struct {
+	req ipc.Request
+	err error
+}
+
+// handle serves framed requests on conn until the client hangs up. Frames
+// are read in the background so that a connection failing cancels the
+// command in progress. A client that only closed its write side still gets
+// a reply to every request it sent.
+func (s *server) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cred, err := ipc.PeerCred(conn)
+	if err != nil {
+		// Without credentials no ACL can be checked, refuse the client
+		// instead of treating it as an unknown user.
+		slog.Error("Unable to read peer credentials, closing connection", "err", err)
+		resp := ipc.NewError(nil, ipc.ErrPermissionDenied, fmt.Errorf("unable to read peer credentials: %v", err))
+		s.record(nil, nil, resp)
+		s.count(nil, resp)
+		reply(conn, resp)
+		return
+	}
+	slog.Debug("Connection accepted", "uid", cred.Uid, "gid", cred.Gid, "pid", cred.Pid)
+	// A reply that can not be written means the client is gone.
+	send := func(r *ipc.Response) {
+		if err := reply(conn, r); err != nil {
+			cancel()
+		}
+	}
+	frames := make(chan frame)
+	go s.readFrames(ctx, cancel, conn, frames)
+	for f := range frames {
+		var toolarge *ipc.TooLargeError
+		var decode *ipc.DecodeError
+		switch {
+		case f.err == nil:
+			slog.Debug("Request", "id", f.req.ID, "command", f.req.Name, "args", f.req.Args, "async", f.req.Async, "stream", f.req.Stream)
+			if s.draining.Load() {
+				send(ipc.NewError(&f.req, ipc.ErrShuttingDown, fmt.Errorf("daemon is shutting down")))
+				continue
+			}
+			var events Arkcommand.LineFunc
+			if f.req.Stream {
+				id := f.req.ID
+				events = func(stream, line string) {
+					send(&ipc.Response{Version: ipc.Version, ID: id, OK: true, Output: &ipc.Output{Stream: stream, Line: line}})
+				}
+			}
+			resp := s.execute(ctx, &f.req, cred, events)
+			s.record(cred, &f.req, resp)
+			s.count(&f.req, resp)
+			send(resp)
+		case errors.As(f.err, &toolarge):
+			slog.Warn("Bad request", "err", f.err)
+			resp := ipc.NewError(nil, ipc.ErrTooLarge, f.err)
+			s.record(cred, nil, resp)
+			s.count(nil, resp)
+			send(resp)
+		case errors.As(f.err, &decode):
+			slog.Warn("Bad request", "err", f.err)
+			resp := ipc.NewError(nil, ipc.ErrBadRequest, f.err)
+			s.record(cred, nil, resp)
+			s.count(nil, resp)
+			send(resp)
+		}
+	}
+}
+
+// readFrames feeds frames read from conn to handle until the client is
+// done sending. A read error other than the end of the stream cancels the
+// connection context.
+func (s *server) readFrames(ctx context.Context, cancel context.CancelFunc, conn net.Conn, frames chan<- frame) {
+	defer close(frames)
+	r := bufio.NewReader(conn)
+	for {
+		var f frame
+		f.err = ipc.ReadMsg(r, s.state().c.maxbuff, &f.req)
+		var toolarge *ipc.TooLargeError
+		var decode *ipc.DecodeError
+		if f.err != nil && !errors.As(f.err, &toolarge) && !errors.As(f.err, &decode) {
+			if f.err == io.EOF {
+				// Closed or half closed, the requests read so far
+				// still run and get their replies.
+				return
+			}
+			if s.draining.Load() {
+				// Interrupted by shutdown, the client is still there.
+				return
+			}
+			slog.Warn("Unable to read request", "err", f.err)
+			cancel()
+			return
+		}
+		select {
+		case frames <- f:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// execute serves a single request. events, when not nil, receives the
+// output of the command line by line while it runs.
+func (s *server) execute(ctx context.Context, req *ipc.Request, cred *ipc.Cred, events Arkcommand.LineFunc) *ipc.Response {
+	if req.Version > ipc.Version {
+		return ipc.NewError(req, ipc.ErrUnsupportedVersion, fmt.Errorf("version %d not supported", req.Version))
+	}
+	uid, gid := -1, -1
+	if cred != nil {
+		uid, gid = cred.Uid, cred.Gid
+	}
+	switch req.Name {
+	case ipc.JobStatusCmd, ipc.JobWaitCmd, ipc.JobCancelCmd:
+		return s.jobRequest(ctx, req, uid)
+	case ipc.ListCmd:
+		return s.listCommands(req, uid, gid)
+	case ipc.StatusCmd:
+		return s.status(req)
+	}
+	lg := slog.With("command", req.Name, "id", req.ID, "uid", uid)
+	cmd, err := Arkcommand.Lookup(s.state().cmds, req.Name)
+	if err != nil {
+		lg.Warn("Rejected", "err", err)
+		return ipc.NewError(req, ipc.ErrUnknownCommand, err)
+	}
+	if !cmd.Allowed(uid, gid) {
+		lg.Warn("Denied", "gid", gid)
+		return ipc.NewError(req, ipc.ErrPermissionDenied, fmt.Errorf("not allowed to run %s", req.Name))
+	}
+	cmd, err = cmd.Bind(req.Args)
+	if err != nil {
+		lg.Warn("Invalid arguments", "err", err)
+		return ipc.NewError(req, ipc.ErrInvalidArgs, err)
+	}
+	if req.Async {
+		if req.Stream {
+			return ipc.NewError(req, ipc.ErrBadRequest, fmt.Errorf("async requests can not be streamed"))
+		}
+		s.busy.Add(1)
+		job, err := s.jobs.Start(s.ctx, req.Name, uid, func(ctx context.Context, id string) *ipc.Response {
+			defer s.busy.Done()
+			resp := s.run(ctx, req, cmd, nil)
+			s.record(cred, req, &ipc.Response{
+				Version:     resp.Version,
+				ID:          resp.ID,
+				OK:          resp.OK,
+				ExitCode:    resp.ExitCode,
+				DurationMs:  resp.DurationMs,
+				Error:       resp.Error,
+				Regenerated: resp.Regenerated,
+				Job:         &ipc.JobStatus{ID: id},
+			})
+			return resp
+		})
+		if err != nil {
+			s.busy.Done()
+			lg.Warn("Unable to start job", "err", err)
+			return ipc.NewError(req, ipc.ErrBusy, err)
+		}
+		lg.Info("Started job", "job", job.ID)
+		return &ipc.Response{Version: ipc.Version, ID: req.ID, OK: true, Job: &job}
+	}
+	return s.run(ctx, req, cmd, events)
+}
+
+// run executes cmd. CheckPF regenerates the pf config instead, the
+// installer already checks and loads it, so its command is not run.
+func (s *server) run(ctx context.Context, req *ipc.Request, cmd Arkcommand.Cmd, events Arkcommand.LineFunc) *ipc.Response {
+	start := time.Now()
+	lg := slog.With("command", req.Name, "id", req.ID)
+	if req.Name == Arkcommand.CheckPF {
+		sum, err := s.regenerate(ctx)
+		if err != nil {
+			lg.Error("Error creating pf config file", "router", s.state().pfcfg.Router, "err", err)
+			return ipc.NewError(req, ipc.ErrRegenFailed, err)
+		}
+		if !sum.Reloaded {
+			lg.Info("pf ruleset unchanged, not reloading", "tables", strings.Join(sum.Tables, ","))
+		}
+		return &ipc.Response{
+			Version:     ipc.Version,
+			ID:          req.ID,
+			OK:          true,
+			DurationMs:  time.Since(start).Milliseconds(),
+			Regenerated: true,
+			Diff:        sum.Diff(),
+		}
+	}
+	s.queued.Add(1)
+	release, err := cmd.Acquire(ctx, s.cfglock)
+	s.queued.Add(-1)
+	if err != nil {
+		return ipc.NewError(req, ipc.ErrCanceled, err)
+	}
+	defer release()
+	s.running.Add(1)
+	res, err := cmd.Stream(ctx, events)
+	s.running.Add(-1)
+	metrics.CommandDuration.Observe(res.Duration.Seconds(), req.Name)
+	resp := &ipc.Response{
+		Version:    ipc.Version,
+		ID:         req.ID,
+		OK:         err == nil,
+		ExitCode:   res.ExitCode,
+		Stdout:     res.Stdout,
+		Stderr:     res.Stderr,
+		Truncated:  res.Truncated,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		lg.Warn("Command failed", "exit_code", res.ExitCode, "err", err)
+		code := ipc.ErrExecFailed
+		switch {
+		case res.TimedOut:
+			code = ipc.ErrTimeout
+		case res.Canceled:
+			code = ipc.ErrCanceled
+		case res.ExitCode > 0:
+			code = ipc.ErrNonZeroExit
+		}
+		resp.Error = &ipc.Error{Code: code, Message: err.Error()}
+	}
+	return resp
+}
+
+// jobRequest serves the job.* built in requests.
+func (s *server) jobRequest(ctx context.Context, req *ipc.Request, uid int) *ipc.Response {
+	id := req.Args["id"]
+	var job ipc.JobStatus
+	var err error
+	switch req.Name {
+	case ipc.JobStatusCmd:
+		job, err = s.jobs.Status(id, uid)
+	case ipc.JobWaitCmd:
+		if t, ok := req.Args["timeout"]; ok {
+			secs, perr := strconv.Atoi(t)
+			if perr != nil || secs <= 0 {
+				return ipc.NewError(req, ipc.ErrInvalidArgs, fmt.Errorf("invalid timeout %q", t))
+			}
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(secs)*time.Second)
+			defer cancel()
+		}
+		job, err = s.jobs.Wait(ctx, id, uid)
+	case ipc.JobCancelCmd:
+		job, err = s.jobs.Cancel(id, uid)
+	}
+	if err != nil {
+		return ipc.NewError(req, ipc.ErrUnknownJob, err)
+	}
+	return &ipc.Response{Version: ipc.Version, ID: req.ID, OK: true, Job: &job}
+}
+
+// listCommands replies with the allowlisted commands the peer may run.
+func (s *server) listCommands(req *ipc.Request, uid, gid int) *ipc.Response {
+	resp := &ipc.Response{Version: ipc.Version, ID: req.ID, OK: true, Commands: []ipc.CommandInfo{}}
+	for _, cmd := range s.state().cmds {
+		if !cmd.Allowed(uid, gid) {
+			continue
+		}
+		name, params := cmd.Describe()
+		info := ipc.CommandInfo{Name: name}
+		for _, p := range params {
+			info.Params = append(info.Params, ipc.ParamInfo{Name: p.Name, Type: p.Type, Values: p.Values})
+		}
+		resp.Commands = append(resp.Commands, info)
+	}
+	sort.Slice(resp.Commands, func(i, j int) bool {
+		return resp.Commands[i].Name < resp.Commands[j].Name
+	})
+	return resp
+}
+
+// status reports how the daemon is doing: enrollment, the api token, the
+// last pf config generations and how busy it is.
+func (s *server) status(req *ipc.Request) *ipc.Response {
+	st := &ipc.Status{
+		Version: version,
+		Started: s.started,
+		Uptime:  int64(time.Since(s.started).Seconds()),
+	}
+	cur := s.state()
+	st.Router = cur.pfcfg.Router
+	st.TokenValid = *cur.token != ""
+	if exp, ok := tokenExpiry(*cur.token); ok {
+		st.TokenExpires = &exp
+		st.TokenValid = st.TokenValid && time.Now().Before(exp)
+	}
+	s.health.fill(st)
+	st.Queued = s.queued.Load()
+	st.Running = s.running.Load()
+	return &ipc.Response{Version: ipc.Version, ID: req.ID, OK: true, Status: st}
+}
+
+// record writes req and its outcome to the audit log. req is nil when the
+// request could not be read.
+func (s *server) record(cred *ipc.Cred, req *ipc.Request, resp *ipc.Response) {
+	e := audit.Entry{
+		Uid:         -1,
+		Gid:         -1,
+		Pid:         -1,
+		RequestID:   resp.ID,
+		OK:          resp.OK,
+		ExitCode:    resp.ExitCode,
+		DurationMs:  resp.DurationMs,
+		Regenerated: resp.Regenerated,
+	}
+	if cred != nil {
+		e.Uid, e.Gid, e.Pid = cred.Uid, cred.Gid, cred.Pid
+	}
+	if req != nil {
+		e.Command = req.Name
+		e.Args = req.Args
+	}
+	if resp.Job != nil {
+		e.Job = resp.Job.ID
+	}
+	if resp.Error != nil {
+		e.Error = resp.Error.Code
+	}
+	if err := s.state().audit.Write(e); err != nil {
+		slog.Error("Audit log error", "err", err)
+	}
+}
+
+// count adds req to the request metrics. Names that are not built in or
+// allowlisted are counted as "unknown" so clients can not add series.
+func (s *server) count(req *ipc.Request, resp *ipc.Response) {
+	name := "unknown"
+	if req != nil {
+		switch req.Name {
+		case ipc.JobStatusCmd, ipc.JobWaitCmd, ipc.JobCancelCmd, ipc.ListCmd, ipc.StatusCmd:
+			name = req.Name
+		default:
+			if _, ok := s.state().cmds[req.Name]; ok {
+				name = req.Name
+			}
+		}
+	}
+	result := "ok"
+	if resp.Error != nil {
+		result = resp.Error.Code
+	}
+	metrics.Requests.Inc(name, result)
+}
+
+func reply(conn net.Conn, r *ipc.Response) error {
+	err := ipc.WriteMsg(conn, r)
+	if err != nil {
+		slog.Warn("Reply error", "err", err)
+	}
+	return err
+}
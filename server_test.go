@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	Arkcommand "github.com/rbaylon/arkgated/arkcommand"
+	"github.com/rbaylon/arkgated/audit"
+	"github.com/rbaylon/arkgated/ipc"
+)
+
+// testConfig returns the config of a daemon with a temporary rundir
+// holding the sample config.json and a command file with cmds, the json
+// of the "cmds" array. The api is unreachable.
+func testConfig(t *testing.T, cmds string) *config {
+	t.Helper()
+	dir := t.TempDir() + "/"
+	cfg, err := os.ReadFile("rundir/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir+"config.json", cfg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmdfile := filepath.Join(dir, "cmd.json")
+	if err := os.WriteFile(cmdfile, []byte(`{"cmds": [`+cmds+`]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := &config{}
+	err = c.init([]string{"arkgated", "-rundir", dir, "-cmdfile", cmdfile,
+		"-srvcurl", "http://127.0.0.1:1/", "-socketfile", dir + "arkgated.sock",
+		"-shutdowntimeout", "2s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// testState loads the state of testConfig, with an empty token.
+func testState(t *testing.T, cmds string) *state {
+	t.Helper()
+	st, err := loadState(testConfig(t, cmds), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.audit.Close() })
+	return st
+}
+
+// testServer serves st on a fresh socket and returns the socket path and
+// the cancel func of the server context. The server is shut down when the
+// test ends.
+func testServer(t *testing.T, st *state) (*server, string, context.CancelFunc) {
+	t.Helper()
+	ln, err := net.Listen("unix", st.c.sockfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newServer(ctx, st, nil, false)
+	s.serveListener(ln)
+	t.Cleanup(func() { s.shutdown(st.c.drain, cancel) })
+	return s, st.c.sockfile, cancel
+}
+
+// allowAll is an acl letting the test user run a command.
+func allowAll() string {
+	return fmt.Sprintf(`"acl": {"uids": [%d], "gids": []}`, os.Getuid())
+}
+
+// pipeline dials path and sends a request to run name for each of ids
+// without waiting for replies.
+func pipeline(t *testing.T, path, name string, ids ...string) (*net.UnixConn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	for _, id := range ids {
+		if err := ipc.WriteMsg(conn, &ipc.Request{Version: ipc.Version, ID: id, Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	return conn.(*net.UnixConn), bufio.NewReader(conn)
+}
+
+// readReply reads the next reply and checks that it answers id.
+func readReply(t *testing.T, r *bufio.Reader, id string) *ipc.Response {
+	t.Helper()
+	var resp ipc.Response
+	if err := ipc.ReadMsg(r, 1<<20, &resp); err != nil {
+		t.Fatalf("reply %s: %v", id, err)
+	}
+	if resp.ID != id {
+		t.Fatalf("reply for %q, want %q", resp.ID, id)
+	}
+	return &resp
+}
+
+// waitRunning waits until n commands are executing on s.
+func waitRunning(t *testing.T, s *server, n int64) {
+	t.Helper()
+	for i := 0; s.running.Load() != n; i++ {
+		if i == 500 {
+			t.Fatalf("%d commands running, want %d", s.running.Load(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPipelinedHalfClose(t *testing.T) {
+	st := testState(t, `{"name": "SLEEP", "cmd": "/bin/sleep", "opts": ["0.2"], `+allowAll()+`}`)
+	_, path, _ := testServer(t, st)
+	conn, r := pipeline(t, path, "SLEEP", "1", "2")
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2"} {
+		if resp := readReply(t, r, id); !resp.OK {
+			t.Errorf("reply %s: error %+v", id, resp.Error)
+		}
+	}
+}
+
+func TestShutdownFinishesRequestInProgress(t *testing.T) {
+	st := testState(t, `{"name": "SLEEP", "cmd": "/bin/sleep", "opts": ["0.3"], `+allowAll()+`}`)
+	s, path, cancel := testServer(t, st)
+	_, r := pipeline(t, path, "SLEEP", "1", "2")
+	waitRunning(t, s, 1)
+	done := make(chan struct{})
+	go func() {
+		s.shutdown(5*time.Second, cancel)
+		close(done)
+	}()
+	if resp := readReply(t, r, "1"); !resp.OK {
+		t.Errorf("request in progress: error %+v", resp.Error)
+	}
+	if resp := readReply(t, r, "2"); resp.OK || resp.Error == nil || resp.Error.Code != ipc.ErrShuttingDown {
+		t.Errorf("next request: got %+v, want %s", resp, ipc.ErrShuttingDown)
+	}
+	<-done
+}
+
+func TestShutdownDeadlineCancels(t *testing.T) {
+	// The shell waits on a subshell that leaves a file behind unless the
+	// whole process group is killed.
+	leftover := filepath.Join(t.TempDir(), "leftover")
+	st := testState(t, fmt.Sprintf(`{"name": "SLEEP", "cmd": "/bin/sh", "opts": ["-c", "(sleep 0.5; touch %s) & wait"], %s}`, leftover, allowAll()))
+	s, path, cancel := testServer(t, st)
+	_, r := pipeline(t, path, "SLEEP", "1")
+	waitRunning(t, s, 1)
+	start := time.Now()
+	go s.shutdown(100*time.Millisecond, cancel)
+	resp := readReply(t, r, "1")
+	if resp.OK || resp.Error == nil || resp.Error.Code != ipc.ErrCanceled {
+		t.Errorf("got %+v, want %s", resp, ipc.ErrCanceled)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("canceled after %v", d)
+	}
+	time.Sleep(time.Second)
+	if _, err := os.Stat(leftover); err == nil {
+		t.Error("background process survived the cancel")
+	}
+}
+
+func TestRegenerateFetchesUnlocked(t *testing.T) {
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fetching)
+		<-release
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer api.Close()
+	st := testState(t, "")
+	st.c.srvcurl = api.URL + "/"
+	s, _, _ := testServer(t, st)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.regenerate(context.Background())
+		errc <- err
+	}()
+	<-fetching
+	if !s.cfglock.TryAcquire(Arkcommand.LockWeight) {
+		t.Error("config lock held while fetching subscribers")
+	} else {
+		s.cfglock.Release(Arkcommand.LockWeight)
+	}
+	close(release)
+	if err := <-errc; err == nil {
+		t.Error("regenerate succeeded on a 503")
+	}
+}
+
+func TestReloadKeepsStateOnFailedRegen(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer api.Close()
+	st := testState(t, "")
+	st.c.srvcurl = api.URL + "/"
+	s, _, _ := testServer(t, st)
+	cfg, err := os.ReadFile(st.c.rundir + "config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = bytes.Replace(cfg, []byte(`"router": "devopenbsd"`), []byte(`"router": "other"`), 1)
+	if err := os.WriteFile(st.c.rundir+"config.json", cfg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	args := append(st.c.args, "-srvcurl", st.c.srvcurl, "-auditlog", "other.log")
+	s.reload(args, io.Discard)
+	if s.state() != st {
+		t.Fatal("state replaced although its pf config failed to install")
+	}
+	if err := st.audit.Write(audit.Entry{Command: "TEST"}); err != nil {
+		t.Errorf("old audit log closed: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// probeTimeout bounds the check for a live daemon on an existing socket.
+const probeTimeout = time.Second
+
+// unixListener removes its socket file on Close. The file is created under
+// a temporary name, so the removal done by net.UnixListener would miss it.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// listen creates the unix socket for c, accessible to the arkgate group.
+func listen(c *config) (*unixListener, error) {
+	return listenUnix(c.sockfile, c.arkgid)
+}
+
+// listenUnix creates a unix socket at path, accessible to group gid. A
+// socket left behind by a daemon that died is removed, one that still
+// answers makes listenUnix fail. The socket is created in a private
+// directory and only linked to its real path once its owner and mode are
+// set, so no one can connect to it before that.
+func listenUnix(path string, gid int) (*unixListener, error) {
+	if err := removeStale(path); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".arkgated-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	err = os.Chown(tmp, os.Getuid(), gid)
+	if err == nil {
+		err = os.Chmod(tmp, 0660)
+	}
+	if err == nil {
+		// Unlike rename, link fails if another daemon got there first.
+		err = os.Link(tmp, path)
+		if errors.Is(err, os.ErrExist) {
+			err = fmt.Errorf("%s appeared while starting, is another arkgated running?", path)
+		}
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ln, path: path}, nil
+}
+
+// removeStale deletes path if it is a socket nobody listens on.
+func removeStale(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, probeTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("another arkgated is running on %s", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("probing %s: %v", path, err)
+	}
+	return os.Remove(path)
+}
+
+// listenFdsStart is the first file descriptor passed by a service manager
+// using the LISTEN_FDS protocol.
+const listenFdsStart = 3
+
+// inheritedListener returns the socket passed by a service manager through
+// LISTEN_PID and LISTEN_FDS, or nil when there is none. With several
+// sockets the one named arkgated in LISTEN_FDNAMES is used, else the first.
+// The variables are cleared so that child processes do not see them.
+func inheritedListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds < 1 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	fd := listenFdsStart
+	for i, name := range names {
+		if name == "arkgated" && i < nfds {
+			fd = listenFdsStart + i
+		}
+	}
+	for i := 0; i < nfds; i++ {
+		syscall.CloseOnExec(listenFdsStart + i)
+	}
+	f := os.NewFile(uintptr(fd), "listen-fd")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited fd %d: %v", fd, err)
+	}
+	if _, ok := ln.(*net.UnixListener); !ok {
+		ln.Close()
+		return nil, fmt.Errorf("inherited fd %d is not a unix socket", fd)
+	}
+	return ln, nil
+}
+
+// openListener returns the socket inherited from a service manager if
+// there is one and creates c.sockfile otherwise. inherited tells the
+// caller the socket is not ours to move.
+func openListener(c *config) (ln net.Listener, inherited bool, err error) {
+	ln, err = inheritedListener()
+	if err != nil || ln != nil {
+		return ln, ln != nil, err
+	}
+	ln, err = listen(c)
+	return ln, false, err
+}
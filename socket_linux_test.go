@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// inheritChildEnv marks the test binary re-executed by
+// TestInheritedListener with listeners on fd 3 and 4.
+const inheritChildEnv = "ARKGATED_TEST_INHERIT"
+
+func TestInheritedListener(t *testing.T) {
+	if os.Getenv(inheritChildEnv) == "1" {
+		// LISTEN_PID is only known once running.
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		ln, err := inheritedListener()
+		if err != nil || ln == nil {
+			fmt.Printf("error=%v\n", err)
+			return
+		}
+		fmt.Printf("addr=%s\n", ln.Addr())
+		for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			if os.Getenv(v) != "" {
+				fmt.Printf("error=%s still set\n", v)
+			}
+		}
+		return
+	}
+
+	dir := t.TempDir()
+	var files []*os.File
+	for _, name := range []string{"other", "arkgated"} {
+		ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, name), Net: "unix"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		f, err := ln.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInheritedListener$")
+	cmd.Env = append(os.Environ(), inheritChildEnv+"=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=other:arkgated")
+	cmd.ExtraFiles = files
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	want := "addr=" + filepath.Join(dir, "arkgated") + "\n"
+	if !strings.Contains(string(out), want) || strings.Contains(string(out), "error=") {
+		t.Errorf("child output %q, want %q", out, want)
+	}
+}
+
+func TestInheritedListenerOtherPid(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	ln, err := inheritedListener()
+	if ln != nil || err != nil {
+		t.Errorf("got %v, %v for another process's sockets", ln, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "1" {
+		t.Error("variables meant for another process cleared")
+	}
+}
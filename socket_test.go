@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// staleSocket leaves a socket file at path that nobody listens on.
+func staleSocket(t *testing.T, path string) {
+	t.Helper()
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.SetUnlinkOnClose(false)
+	ln.Close()
+}
+
+func TestListenUnix(t *testing.T) {
+	gid := os.Getgid()
+	if os.Getuid() == 0 {
+		// Root can hand the socket to any group, use one it is not in.
+		gid = 12345
+	}
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, path string)
+		wantErr string
+	}{
+		{name: "fresh"},
+		{name: "stale socket", setup: staleSocket},
+		{name: "live socket", setup: func(t *testing.T, path string) {
+			ln, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { ln.Close() })
+		}, wantErr: "another arkgated is running"},
+		{name: "regular file", setup: func(t *testing.T, path string) {
+			if err := os.WriteFile(path, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}, wantErr: "not a socket"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "arkgated.sock")
+		if tt.setup != nil {
+			tt.setup(t, path)
+		}
+		ln, err := listenUnix(path, gid)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			if ln != nil {
+				ln.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0o660 {
+			t.Errorf("%s: mode %v, want socket 0660", tt.name, fi.Mode())
+		}
+		if st := fi.Sys().(*syscall.Stat_t); int(st.Gid) != gid {
+			t.Errorf("%s: gid %d, want %d", tt.name, st.Gid, gid)
+		}
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Errorf("%s: dial: %v", tt.name, err)
+		} else {
+			conn.Close()
+		}
+		ln.Close()
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: socket left behind after Close", tt.name)
+		}
+	}
+}
@@ -2,15 +2,24 @@ package srvclient
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"time"
 
 	pfconfig "github.com/rbaylon/arkgated/config/pf"
+	"github.com/rbaylon/arkgated/metrics"
 )
 
+// Timeout bounds every call to the api, so that a hung server can not
+// stall what waits on it.
+const Timeout = 30 * time.Second
+
+var client = &http.Client{Timeout: Timeout}
+
 type Token struct {
 	Name string
 	Jwt  string
@@ -19,37 +28,51 @@ type Token struct {
 func Enroll(urlbase string, token *string, pf *pfconfig.PfConfig) error {
 	create_url := urlbase + "pfconfig/create"
 	query_url := urlbase + "pfconfig/query/" + pf.Router
-	client := &http.Client{}
 	req, _ := http.NewRequest("GET", query_url, nil)
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", *token))
+	start := time.Now()
 	res, err := client.Do(req)
+	metrics.ObserveAPI("query", start, res, err)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Unable to query router", "router", pf.Router, "err", err)
 		return err
 	}
 	if res.StatusCode != 200 {
 		res.Body.Close()
 		cfg, _ := json.Marshal(pf)
-		log.Println("Enrolling...")
+		slog.Info("Enrolling", "router", pf.Router)
 		req, _ = http.NewRequest("POST", create_url, bytes.NewBuffer(cfg))
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", *token))
-		res, _ = client.Do(req)
+		start = time.Now()
+		res, err = client.Do(req)
+		metrics.ObserveAPI("create", start, res, err)
+		if err != nil {
+			slog.Error("Unable to enroll router", "router", pf.Router, "err", err)
+			return err
+		}
 		defer res.Body.Close()
 		if res.StatusCode != 200 {
 			return fmt.Errorf("Failed to enroll router")
 		}
 	}
-	log.Println("Enrolled")
+	slog.Info("Enrolled", "router", pf.Router)
 	return nil
 }
 
-func GetSubs(url string, token *string) (*pfconfig.PfConfig, error) {
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
+// GetSubs fetches the vouchers and subscribers of a router. A reply that
+// is not 2xx or does not decode is an error, so that a generation is never
+// built from an empty list. The request is abandoned when ctx is done.
+func GetSubs(ctx context.Context, url string, token *string) (*pfconfig.PfConfig, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", *token))
+	start := time.Now()
 	res, err := client.Do(req)
+	metrics.ObserveAPI("subs", start, res, err)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Unable to fetch subscribers", "url", url, "err", err)
 		return nil, err
 	}
 	defer res.Body.Close()
@@ -57,20 +80,28 @@ func GetSubs(url string, token *string) (*pfconfig.PfConfig, error) {
 	if ioerr != nil {
 		return nil, ioerr
 	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		slog.Error("Unable to fetch subscribers", "url", url, "status", res.StatusCode)
+		return nil, fmt.Errorf("fetching subscribers: %s", res.Status)
+	}
 	var cfg pfconfig.PfConfig
-	json.Unmarshal(responseData, &cfg)
+	if err := json.Unmarshal(responseData, &cfg); err != nil {
+		slog.Error("Unable to decode subscribers", "url", url, "err", err)
+		return nil, fmt.Errorf("decoding subscribers: %v", err)
+	}
 	return &cfg, nil
 }
 
 func GetToken(creds string, api_login_url string) (*string, error) {
-	client := &http.Client{}
 	req, _ := http.NewRequest("GET", api_login_url, nil)
 	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", creds))
+	start := time.Now()
 	res, err := client.Do(req)
-	defer res.Body.Close()
+	metrics.ObserveAPI("login", start, res, err)
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 	responseData, ioerr := ioutil.ReadAll(res.Body)
 	if ioerr != nil {
 		return nil, ioerr
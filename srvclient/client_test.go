@@ -0,0 +1,44 @@
+package srvclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetSubs(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		subs   int
+		ok     bool
+	}{
+		{"ok", 200, `{"router":"r1","subs":[{"mac":"aa:bb:cc:dd:ee:01","status":"active"}]}`, 1, true},
+		{"empty", 200, `{}`, 0, true},
+		{"server error", 500, `{"subs":[]}`, 0, false},
+		{"unauthorized", 401, `{"error":"token expired"}`, 0, false},
+		{"not json", 200, `<html>maintenance</html>`, 0, false},
+		{"truncated", 200, `{"subs":[{"mac":`, 0, false},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer tok" {
+				t.Errorf("%s: Authorization = %q", tt.name, r.Header.Get("Authorization"))
+			}
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+		token := "tok"
+		cfg, err := GetSubs(context.Background(), srv.URL+"/pfconfig/query/r1", &token)
+		srv.Close()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok = %v", tt.name, err, tt.ok)
+			continue
+		}
+		if err == nil && len(cfg.Subs) != tt.subs {
+			t.Errorf("%s: %d subs, want %d", tt.name, len(cfg.Subs), tt.subs)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	Arkcommand "github.com/rbaylon/arkgated/arkcommand"
+	"github.com/rbaylon/arkgated/audit"
+	pfconfig "github.com/rbaylon/arkgated/config/pf"
+	"github.com/rbaylon/arkgated/privsep"
+	"github.com/rbaylon/arkgated/srvclient"
+)
+
+// state is everything the daemon loads from its flags and files. It is
+// built in full and swapped in one go on SIGHUP, requests keep using the
+// state they started with.
+type state struct {
+	c     *config
+	pfcfg *pfconfig.PfConfig
+	cmds  map[string]Arkcommand.Cmd
+	token *string
+	audit *audit.Logger
+}
+
+// loadState reads config.json and the command file for c, opens the audit
+// log and fetches an api token. Resources that did not change are taken
+// over from old, which may be nil on startup. Privileged commands run
+// through priv when it is not nil.
+func loadState(c *config, old *state, priv *privsep.Client) (*state, error) {
+	st := &state{c: c}
+	var err error
+	st.pfcfg, err = pfconfig.Init(c.rundir + "config.json")
+	if err != nil {
+		return nil, fmt.Errorf("reading json config: %v", err)
+	}
+	st.cmds, err = Arkcommand.Init(c.cmdfile)
+	if err != nil {
+		return nil, fmt.Errorf("reading command file: %v", err)
+	}
+	if priv != nil {
+		for name, cmd := range st.cmds {
+			if cmd.NeedsRoot() {
+				st.cmds[name] = priv.Wrap(cmd)
+			}
+		}
+	}
+	if old != nil && old.c.creds == c.creds && old.c.srvcurl == c.srvcurl {
+		st.token = old.token
+	} else {
+		st.token, err = srvclient.GetToken(c.creds, c.srvcurl+"login")
+		if err != nil {
+			if old != nil {
+				return nil, fmt.Errorf("authenticating: %v", err)
+			}
+			slog.Warn("Unable to get an api token", "err", err)
+			empty := ""
+			st.token = &empty
+		}
+	}
+	if old != nil && old.c.rundir+old.c.auditlog == c.rundir+c.auditlog &&
+		old.c.auditmax == c.auditmax && old.c.auditkeep == c.auditkeep {
+		st.audit = old.audit
+	} else {
+		st.audit, err = audit.Open(c.rundir+c.auditlog, c.auditmax, c.auditkeep)
+		if err != nil {
+			return nil, fmt.Errorf("opening audit log: %v", err)
+		}
+	}
+	return st, nil
+}
+
+// reload re-reads the flags and config files and switches to the result.
+// Nothing changes when any part of the new state fails to load, or when
+// the pf config it describes can not be generated and installed. out is
+// where logs go when logging to stderr.
+func (s *server) reload(args []string, out io.Writer) {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+	old := s.state()
+	c := &config{}
+	if err := c.init(args); err != nil {
+		slog.Error("Reload failed, keeping old config", "err", err)
+		return
+	}
+	if c.sockfile != old.c.sockfile && s.fixed {
+		slog.Error("Reload failed, keeping old config: the socket was handed to us and can only move on restart")
+		return
+	}
+	st, err := loadState(c, old, s.priv)
+	if err != nil {
+		slog.Error("Reload failed, keeping old config", "err", err)
+		return
+	}
+	// Log files are reopened on every reload so that SIGHUP after rotating
+	// one starts a new file.
+	h, logcloser, err := openLog(c.logoutput, out)
+	if err != nil {
+		if st.audit != old.audit {
+			st.audit.Close()
+		}
+		slog.Error("Reload failed, keeping old config", "err", err)
+		return
+	}
+	var ln *unixListener
+	if c.sockfile != old.c.sockfile {
+		ln, err = listen(c)
+	}
+	changes := diffState(old, st)
+	regen := err == nil && !reflect.DeepEqual(old.pfcfg, st.pfcfg)
+	if regen && old.pfcfg.Router != st.pfcfg.Router {
+		s.health.enroll(srvclient.Enroll(c.srvcurl, st.token, st.pfcfg))
+	}
+	switchState := func() {
+		s.st.Store(st)
+	}
+	if regen {
+		// The candidate only replaces the old state once its pf config
+		// is installed, both under the config lock so that no
+		// generation from the old state is installed after it.
+		_, err = s.generate(old, st, switchState)
+	} else if err == nil {
+		switchState()
+	}
+	if err != nil {
+		if st.audit != old.audit {
+			st.audit.Close()
+		}
+		if logcloser != nil {
+			logcloser.Close()
+		}
+		if ln != nil {
+			ln.Close()
+		}
+		slog.Error("Reload failed, keeping old config", "err", err)
+		return
+	}
+	if ln != nil {
+		s.serveListener(ln)
+		os.Remove(old.c.sockfile)
+	} else if c.arkgid != old.c.arkgid {
+		if err := os.Chown(c.sockfile, os.Getuid(), c.arkgid); err != nil {
+			slog.Warn("Unable to change socket group", "socket", c.sockfile, "err", err)
+		}
+	}
+	logLevel.Set(c.loglevel)
+	useLog(h, logcloser)
+	if st.audit != old.audit {
+		old.audit.Close()
+	}
+	if c.maxjobs != old.c.maxjobs {
+		slog.Warn("maxjobs only takes effect after a restart")
+	}
+	if c.metrics != old.c.metrics {
+		slog.Warn("metricsaddr only takes effect after a restart")
+	}
+	if len(changes) == 0 {
+		slog.Info("Reloaded, nothing changed")
+		return
+	}
+	slog.Info("Reloaded", "changes", strings.Join(changes, "; "))
+}
+
+// diffState describes what differs between two states. Values are left
+// out, creds must not end up in the log.
+func diffState(old, st *state) []string {
+	var changes []string
+	if f := changedFields(*old.c, *st.c); len(f) > 0 {
+		changes = append(changes, "flags: "+strings.Join(f, ", "))
+	}
+	if f := changedFields(*old.pfcfg, *st.pfcfg); len(f) > 0 {
+		changes = append(changes, "config.json: "+strings.Join(f, ", "))
+	}
+	var added, removed, changed []string
+	for name, cmd := range st.cmds {
+		oldcmd, ok := old.cmds[name]
+		if !ok {
+			added = append(added, name)
+			continue
+		}
+		a, _ := json.Marshal(oldcmd)
+		b, _ := json.Marshal(cmd)
+		if string(a) != string(b) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old.cmds {
+		if _, ok := st.cmds[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	for _, l := range []struct {
+		what  string
+		names []string
+	}{{"commands added", added}, {"commands removed", removed}, {"commands changed", changed}} {
+		if len(l.names) > 0 {
+			sort.Strings(l.names)
+			changes = append(changes, l.what+": "+strings.Join(l.names, ", "))
+		}
+	}
+	return changes
+}
+
+// changedFields returns the names of the fields that differ between two
+// values of the same struct type.
+func changedFields(a, b any) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	var names []string
+	for i := 0; i < va.NumField(); i++ {
+		if fmt.Sprintf("%v", va.Field(i)) != fmt.Sprintf("%v", vb.Field(i)) {
+			names = append(names, va.Type().Field(i).Name)
+		}
+	}
+	return names
+}
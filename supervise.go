@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/namsral/flag"
+)
+
+type superconfig struct {
+	pidfile    string
+	lockfile   string
+	logfile    string
+	minbackoff time.Duration
+	maxbackoff time.Duration
+	resetafter time.Duration
+	args       []string
+}
+
+func (sc *superconfig) init(args []string) error {
+	flags := flag.NewFlagSet("supervise", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s supervise [flags] [-- arkgated flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	var (
+		pidfile    = flags.String("pidfile", "./rundir/arkgated.pid", "Path to write the supervisor pid to")
+		lockfile   = flags.String("lockfile", "./rundir/arkgated.lock", "Lock file that keeps a second instance from starting")
+		logfile    = flags.String("logfile", "./rundir/arkgated.log", "File the daemon output is appended to")
+		minbackoff = flags.Duration("minbackoff", time.Second, "Delay before the first restart after a crash")
+		maxbackoff = flags.Duration("maxbackoff", 5*time.Minute, "Longest delay between restarts")
+		resetafter = flags.Duration("resetafter", time.Minute, "Run time after which a crash no longer counts towards the backoff")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	sc.pidfile = *pidfile
+	sc.lockfile = *lockfile
+	sc.logfile = *logfile
+	sc.minbackoff = *minbackoff
+	sc.maxbackoff = *maxbackoff
+	sc.resetafter = *resetafter
+	sc.args = flags.Args()
+	return nil
+}
+
+// lock takes an exclusive lock on path for as long as the process lives.
+func lock(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("another instance holds %s", path)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// supervise runs arkgated as a child process and restarts it when it dies,
+// waiting longer after every crash in a row. SIGINT and SIGTERM stop the
+// child and the supervisor, SIGHUP is passed on to the child.
+func supervise(args []string) int {
+	sc := &superconfig{}
+	if err := sc.init(args); err != nil {
+		return 2
+	}
+	lockf, err := lock(sc.lockfile)
+	if err != nil {
+		if pid, perr := os.ReadFile(sc.pidfile); perr == nil {
+			err = fmt.Errorf("%v, pid %s", err, strings.TrimSpace(string(pid)))
+		}
+		fmt.Fprintln(os.Stderr, "arkgated:", err)
+		return 1
+	}
+	defer lockf.Close()
+	logf, err := os.OpenFile(sc.logfile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "arkgated:", err)
+		return 1
+	}
+	defer logf.Close()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.MultiWriter(os.Stderr, logf), nil)))
+	err = os.WriteFile(sc.pidfile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		slog.Error("Unable to write pidfile", "pidfile", sc.pidfile, "err", err)
+		return 1
+	}
+	defer os.Remove(sc.pidfile)
+
+	self, err := os.Executable()
+	if err != nil {
+		slog.Error("Unable to find arkgated", "err", err)
+		return 1
+	}
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	backoff := sc.minbackoff
+	for {
+		cmd := exec.Command(self, sc.args...)
+		cmd.Stdout = logf
+		cmd.Stderr = logf
+		// Keep terminal signals away from the child, it only gets the ones
+		// the supervisor forwards.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		started := time.Now()
+		if err := cmd.Start(); err != nil {
+			slog.Error("Unable to start arkgated", "err", err)
+			return 1
+		}
+		slog.Info("Started arkgated", "pid", cmd.Process.Pid)
+		exited := make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+
+		stopping := false
+		var werr error
+	wait:
+		for {
+			select {
+			case s := <-sigchan:
+				cmd.Process.Signal(s)
+				if s != syscall.SIGHUP {
+					slog.Info("Stopping arkgated", "signal", s)
+					stopping = true
+				}
+			case werr = <-exited:
+				break wait
+			}
+		}
+		if stopping {
+			slog.Info("arkgated stopped", "state", cmd.ProcessState)
+			return 0
+		}
+		if werr == nil {
+			slog.Info("arkgated exited cleanly, not restarting")
+			return 0
+		}
+		if time.Since(started) > sc.resetafter {
+			backoff = sc.minbackoff
+		}
+		slog.Warn("arkgated died, restarting", "err", werr, "backoff", backoff)
+		select {
+		case s := <-sigchan:
+			if s != syscall.SIGHUP {
+				slog.Info("Not restarting", "signal", s)
+				return 0
+			}
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > sc.maxbackoff {
+			backoff = sc.maxbackoff
+		}
+	}
+}